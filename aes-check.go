@@ -0,0 +1,410 @@
+package main
+
+/*
+  Check the hand-written AES of encrypt-auth (-aes scratch) against the test
+  vectors of FIPS-197, and against Go's crypto/aes on random keys and blocks.
+  USAGE: $ go run aes-check.go [-n <number of random blocks>] [-trace 128|192|256] [-src <directory>]
+  flags: n    : how many random blocks to compare for each key size, 1000 by
+                default.
+         trace: print every step of encrypting and decrypting the example of
+                FIPS-197 Appendix C with a key of that many bits, instead of
+                checking anything. The output reads line for line like the
+                appendix.
+         src  : directory holding encrypt-auth.go and aes-check.go, "." by
+                default.
+  The implementation here is a copy of the one in encrypt-auth. The copy is
+  compared with encrypt-auth.go first, and any difference fails the check.
+*/
+
+import (
+  "fmt"
+  "os"
+  "encoding/hex"
+  "encoding/binary"
+  "crypto/aes"
+  "crypto/rand"
+  "math/bits"
+  "bytes"
+  "strings"
+  "io/ioutil"
+  "path/filepath"
+  "go/ast"
+  "go/parser"
+  "go/token"
+  "flag"
+)
+
+// the declarations copied from encrypt-auth.go, see `checkCopies`
+var copied = []string{"scratchAES", "sbox", "invSbox", "init", "gmul", "newScratchAES", "subWord", "scratchAES.BlockSize", "scratchAES.Encrypt", "scratchAES.Decrypt", "scratchAES.addRoundKey", "subBytes", "shiftRows", "mixColumns", "scratchAES.show"}
+
+// the keys, plaintexts and ciphertexts of the examples in FIPS-197, Appendix B
+// and Appendix C
+var vectors = []struct {
+  key, plainText, cipherText string
+}{
+  {"2b7e151628aed2a6abf7158809cf4f3c", "3243f6a8885a308d313198a2e0370734", "3925841d02dc09fbdc118597196a0b32"},
+  {"000102030405060708090a0b0c0d0e0f", "00112233445566778899aabbccddeeff", "69c4e0d86a7b0430d8cdb78070b4c55a"},
+  {"000102030405060708090a0b0c0d0e0f1011121314151617", "00112233445566778899aabbccddeeff", "dda97ca4864cdfe06eaf70a0ec0d7191"},
+  {"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", "00112233445566778899aabbccddeeff", "8ea2b7ca516745bfeafc49904b496089"},
+}
+
+//routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  nFlag := flag.Int("n", 1000, "number of random blocks to compare with crypto/aes, for each key size")
+  traceFlag := flag.Int("trace", 0, "key size in bits of the Appendix C example to print step by step, instead of checking anything")
+  srcFlag := flag.String("src", ".", "directory holding encrypt-auth.go and aes-check.go")
+  flag.Parse()
+  if flag.NArg() != 0 || *nFlag < 0 || !(*traceFlag == 0 || *traceFlag == 128 || *traceFlag == 192 || *traceFlag == 256) {
+    fmt.Println("usage: go run aes-check.go [-n <number of random blocks>] [-trace 128|192|256] [-src <directory>]")
+    os.Exit(1)
+  }
+  if *traceFlag != 0 {
+    // Appendix C uses the key 00 01 02 ... of the size asked for
+    v := vectors[*traceFlag / 64 - 1]
+    key, _ := hex.DecodeString(v.key)
+    plainText, _ := hex.DecodeString(v.plainText)
+    c, err := newScratchAES(key, true)
+    check(err)
+    fmt.Printf("PLAINTEXT: %s\nKEY:       %s\n\nCIPHER (ENCRYPT):\n", v.plainText, v.key)
+    cipherText := make([]byte, 16)
+    c.Encrypt(cipherText, plainText)
+    fmt.Printf("\nINVERSE CIPHER (DECRYPT):\n")
+    c.Decrypt(plainText, cipherText)
+    return
+  }
+
+  failed := checkCopies(*srcFlag, "aes-check.go", "encrypt-auth.go")
+  for _, v := range vectors {
+    key, _ := hex.DecodeString(v.key)
+    plainText, _ := hex.DecodeString(v.plainText)
+    c, err := newScratchAES(key, false)
+    check(err)
+    encrypted := make([]byte, 16)
+    c.Encrypt(encrypted, plainText)
+    decrypted := make([]byte, 16)
+    c.Decrypt(decrypted, encrypted)
+    name := fmt.Sprintf("AES-%d %s", 8 * len(key), v.plainText)
+    if hex.EncodeToString(encrypted) != v.cipherText || !bytes.Equal(decrypted, plainText) {
+      failed++
+      fmt.Printf("FAIL  %s: got %x back as %x, want %s\n", name, encrypted, decrypted, v.cipherText)
+    } else {
+      fmt.Printf("PASS  %s\n", name)
+    }
+  }
+
+  // a fresh random key for every block, of each size
+  mismatches := 0
+  for _, keyLen := range []int{16, 24, 32} {
+    for i := 0; i < *nFlag; i++ {
+      key := make([]byte, keyLen)
+      block := make([]byte, 16)
+      _, err := rand.Read(key)
+      check(err)
+      _, err = rand.Read(block)
+      check(err)
+      want, err := aes.NewCipher(key)
+      check(err)
+      c, err := newScratchAES(key, false)
+      check(err)
+      got, wanted := make([]byte, 16), make([]byte, 16)
+      c.Encrypt(got, block)
+      want.Encrypt(wanted, block)
+      ok := bytes.Equal(got, wanted)
+      c.Decrypt(got, block)
+      want.Decrypt(wanted, block)
+      if !ok || !bytes.Equal(got, wanted) {
+        mismatches++
+        if mismatches <= 5 {
+          fmt.Printf("FAIL  key %x, block %x\n", key, block)
+        }
+      }
+    }
+  }
+  fmt.Printf("%d of %d random blocks encrypt and decrypt the same as crypto/aes\n", 3 * *nFlag - mismatches, 3 * *nFlag)
+  if failed + mismatches != 0 {
+    os.Exit(1)
+  }
+}
+
+/*
+Compare the declarations in `copied` with the ones in each of the `originals`,
+text and doc comments included, all of them read from `src`. A change made to
+one of those programs but not to the copy here then fails the check, instead
+of leaving it to test code that no longer ships. Returns the number of
+declarations that differ.
+*/
+func checkCopies(src, own string, originals ...string) int {
+  mine := declarations(filepath.Join(src, own))
+  failed := 0
+  for _, original := range originals {
+    theirs := declarations(filepath.Join(src, original))
+    for _, name := range copied {
+      if mine[name] == "" || mine[name] != theirs[name] {
+        failed++
+        fmt.Printf("FAIL  %s is not the same as in %s\n", name, original)
+      }
+    }
+  }
+  if failed == 0 {
+    fmt.Printf("PASS  %d declarations the same as in %s\n", len(copied), strings.Join(originals, " and "))
+  }
+  return failed
+}
+
+/*
+The source text of every top-level declaration in the Go file `fileName`, from
+its doc comment to its end, by name. Methods go by "Type.method", and every
+name in a grouped declaration maps to the whole group.
+*/
+func declarations(fileName string) map[string]string {
+  data, err := ioutil.ReadFile(fileName)
+  check(err)
+  fset := token.NewFileSet()
+  file, err := parser.ParseFile(fset, fileName, data, parser.ParseComments)
+  check(err)
+  res := map[string]string{}
+  for _, decl := range file.Decls {
+    start := decl.Pos()
+    var names []string
+    switch d := decl.(type) {
+    case *ast.FuncDecl:
+      if d.Doc != nil {
+        start = d.Doc.Pos()
+      }
+      name := d.Name.Name
+      if d.Recv != nil {
+        recv := d.Recv.List[0].Type
+        if star, ok := recv.(*ast.StarExpr); ok {
+          recv = star.X
+        }
+        name = recv.(*ast.Ident).Name + "." + name
+      }
+      names = append(names, name)
+    case *ast.GenDecl:
+      if d.Doc != nil {
+        start = d.Doc.Pos()
+      }
+      for _, spec := range d.Specs {
+        switch s := spec.(type) {
+        case *ast.TypeSpec:
+          names = append(names, s.Name.Name)
+        case *ast.ValueSpec:
+          for _, n := range s.Names {
+            names = append(names, n.Name)
+          }
+        }
+      }
+    }
+    text := string(data[fset.Position(start).Offset:fset.Position(decl.End()).Offset])
+    for _, name := range names {
+      res[name] = text
+    }
+  }
+  return res
+}
+
+/*
+AES written out by hand, following FIPS-197, for 16, 24 and 32-byte keys. It
+is a cipher.Block like the one crypto/aes gives, so every mode can run on it.
+The state is kept in input order: byte r + 4c is row r of column c. With
+`trace` set, every step of every round is printed the way Appendix C of
+FIPS-197 lists them, so a block can be followed against the standard line by
+line.
+*/
+type scratchAES struct {
+  // the expanded key, four words per round key
+  w []uint32
+  rounds int
+  trace bool
+}
+
+// the S-box and its inverse, worked out in `init`
+var sbox, invSbox [256]byte
+
+/*
+Build the S-box from its definition rather than copying the table: the
+multiplicative inverse in GF(2^8), with 0 going to 0, followed by the affine
+transformation b ^ rotl(b, 1) ^ rotl(b, 2) ^ rotl(b, 3) ^ rotl(b, 4) ^ 0x63.
+*/
+func init() {
+  for x := 0; x < 256; x++ {
+    // x^255 = 1 for every x but 0, so x^254 is the inverse, and 0^254 is 0
+    inv := byte(1)
+    for i := 0; i < 254; i++ {
+      inv = gmul(inv, byte(x))
+    }
+    if x == 0 {
+      inv = 0
+    }
+    s := inv ^ bits.RotateLeft8(inv, 1) ^ bits.RotateLeft8(inv, 2) ^ bits.RotateLeft8(inv, 3) ^ bits.RotateLeft8(inv, 4) ^ 0x63
+    sbox[x] = s
+    invSbox[s] = byte(x)
+  }
+}
+
+// multiplication in GF(2^8), modulo x^8 + x^4 + x^3 + x + 1
+func gmul(a, b byte) byte {
+  var res byte
+  for b != 0 {
+    if b & 1 != 0 {
+      res ^= a
+    }
+    // xtime: a times x
+    if a & 0x80 != 0 {
+      a = a << 1 ^ 0x1b
+    } else {
+      a <<= 1
+    }
+    b >>= 1
+  }
+  return res
+}
+
+/*
+Expand `key` into the round keys (FIPS-197, section 5.2). Every Nk-th word goes
+through RotWord, SubWord and the round constant, and with 256-bit keys the word
+halfway in between goes through SubWord as well.
+*/
+func newScratchAES(key []byte, trace bool) (*scratchAES, error) {
+  if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+    return nil, aes.KeySizeError(len(key))
+  }
+  nk := len(key) / 4
+  rounds := nk + 6
+  w := make([]uint32, 4 * (rounds + 1))
+  for i := 0; i < nk; i++ {
+    w[i] = binary.BigEndian.Uint32(key[4 * i:])
+  }
+  rcon := byte(1)
+  for i := nk; i < len(w); i++ {
+    temp := w[i - 1]
+    if i % nk == 0 {
+      temp = subWord(bits.RotateLeft32(temp, 8)) ^ uint32(rcon) << 24
+      rcon = gmul(rcon, 2)
+    } else if nk > 6 && i % nk == 4 {
+      temp = subWord(temp)
+    }
+    w[i] = w[i - nk] ^ temp
+  }
+  return &scratchAES{w, rounds, trace}, nil
+}
+
+// the S-box applied to each byte of `word`
+func subWord(word uint32) uint32 {
+  return uint32(sbox[word >> 24]) << 24 | uint32(sbox[word >> 16 & 0xff]) << 16 |
+    uint32(sbox[word >> 8 & 0xff]) << 8 | uint32(sbox[word & 0xff])
+}
+
+func (c *scratchAES) BlockSize() int {
+  return 16
+}
+
+// encrypt one block, the cipher of FIPS-197 section 5.1
+func (c *scratchAES) Encrypt(dst, src []byte) {
+  var state [16]byte
+  copy(state[:], src)
+  c.show(0, "input", state)
+  c.addRoundKey(&state, 0, 0, "k_sch")
+  for round := 1; round <= c.rounds; round++ {
+    c.show(round, "start", state)
+    subBytes(&state, &sbox)
+    c.show(round, "s_box", state)
+    shiftRows(&state, 1)
+    c.show(round, "s_row", state)
+    // the last round leaves out MixColumns
+    if round < c.rounds {
+      mixColumns(&state, [4]byte{2, 3, 1, 1})
+      c.show(round, "m_col", state)
+    }
+    c.addRoundKey(&state, round, round, "k_sch")
+  }
+  c.show(c.rounds, "output", state)
+  copy(dst, state[:])
+}
+
+/*
+Decrypt one block with the inverse cipher of FIPS-197 section 5.3: the steps of
+`Encrypt` undone in reverse order, with the round keys taken from the last.
+*/
+func (c *scratchAES) Decrypt(dst, src []byte) {
+  var state [16]byte
+  copy(state[:], src)
+  c.show(0, "iinput", state)
+  c.addRoundKey(&state, c.rounds, 0, "ik_sch")
+  for round := 1; round <= c.rounds; round++ {
+    c.show(round, "istart", state)
+    shiftRows(&state, 3)
+    c.show(round, "is_row", state)
+    subBytes(&state, &invSbox)
+    c.show(round, "is_box", state)
+    c.addRoundKey(&state, c.rounds - round, round, "ik_sch")
+    if round < c.rounds {
+      c.show(round, "ik_add", state)
+      mixColumns(&state, [4]byte{14, 11, 13, 9})
+    }
+  }
+  c.show(c.rounds, "ioutput", state)
+  copy(dst, state[:])
+}
+
+/*
+Xor round key `key` into the state. `round` and `step` are what the trace shows
+the key as, which differ from `key` in the inverse cipher.
+*/
+func (c *scratchAES) addRoundKey(state *[16]byte, key, round int, step string) {
+  var roundKey [16]byte
+  for col := 0; col < 4; col++ {
+    binary.BigEndian.PutUint32(roundKey[4 * col:], c.w[4 * key + col])
+  }
+  c.show(round, step, roundKey)
+  for i := range state {
+    state[i] ^= roundKey[i]
+  }
+}
+
+// each byte of the state replaced by its entry in `box`
+func subBytes(state *[16]byte, box *[256]byte) {
+  for i := range state {
+    state[i] = box[state[i]]
+  }
+}
+
+/*
+Rotate row r of the state left by r * `by` places: `by` is 1 for ShiftRows, and
+3, that is right by r, for InvShiftRows.
+*/
+func shiftRows(state *[16]byte, by int) {
+  old := *state
+  for r := 1; r < 4; r++ {
+    for col := 0; col < 4; col++ {
+      state[r + 4 * col] = old[r + 4 * ((col + r * by) % 4)]
+    }
+  }
+}
+
+/*
+Multiply each column of the state by the circulant matrix whose first row is
+`m`: 2 3 1 1 for MixColumns, 14 11 13 9 for InvMixColumns.
+*/
+func mixColumns(state *[16]byte, m [4]byte) {
+  for col := 0; col < 4; col++ {
+    var a [4]byte
+    copy(a[:], state[4 * col : 4 * col + 4])
+    for r := 0; r < 4; r++ {
+      state[r + 4 * col] = gmul(m[0], a[r]) ^ gmul(m[1], a[(r + 1) % 4]) ^ gmul(m[2], a[(r + 2) % 4]) ^ gmul(m[3], a[(r + 3) % 4])
+    }
+  }
+}
+
+// one line of the trace, as in FIPS-197 Appendix C
+func (c *scratchAES) show(round int, step string, state [16]byte) {
+  if c.trace {
+    fmt.Printf("round[%2d].%-9s %x\n", round, step, state)
+  }
+}
@@ -0,0 +1,161 @@
+package main
+
+/*
+  Run the attacks end to end: each case encrypts a known plaintext with
+  encrypt-auth, runs an attack program on the ciphertext with decrypt-test as
+  the oracle, and checks that the plaintext comes back, or, for the cases the
+  attack should lose, that it does not.
+  USAGE: $ go run attack-check.go [-run <text>] [-src <directory>]
+  flags: run: only run the cases whose name contains `text`.
+         src: directory holding the sources of the programs, "." by default.
+  The programs are built afresh into a temporary directory and the attacks run
+  there, so neither a stale decrypt-test binary nor the test.txt of the
+  queries touches the source directory.
+*/
+
+import (
+  "fmt"
+  "os"
+  "os/exec"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/hex"
+  "strings"
+  "bytes"
+  "flag"
+)
+
+// the key of the examples in README.md
+const keyStr = "69e01355635fd7c8404f823ac591efefea4e0d4b7a72888d46a735149c86f852"
+
+// three blocks and a bit, so that the last block is partly padding
+const plainText = "Attack at dawn, bring the snacks and 2 lamps."
+
+var cases = []struct {
+  name string
+  // extra flags of `encrypt-auth encrypt`
+  encryptArgs []string
+  // attack program and its flags, besides -i and -o
+  attack string
+  attackArgs []string
+  // whether the attack should recover the plaintext
+  recovers bool
+}{
+  {"padding oracle", nil, "decrypt-attack", nil, true},
+  {"padding oracle, hardened", nil, "decrypt-attack", []string{"-oracle-args", "-hardened"}, false},
+  // oracles with a buggy padding check, and an attack told about the bug
+  {"padding check allow-zero", nil, "decrypt-attack", []string{"-check", "allow-zero", "-oracle-args", "-check allow-zero"}, true},
+  {"padding check no-upper-bound", nil, "decrypt-attack", []string{"-check", "no-upper-bound", "-oracle-args", "-check no-upper-bound"}, true},
+  {"padding check first-last", nil, "decrypt-attack", []string{"-check", "first-last", "-oracle-args", "-check first-last"}, true},
+  {"padding check last-byte", nil, "decrypt-attack", []string{"-check", "last-byte", "-oracle-args", "-check last-byte"}, false},
+  // containers whose settings the oracle only learns from the attack
+  {"container, x923 padding", []string{"-container", "-padding", "x923"}, "decrypt-attack", nil, true},
+  {"container, eam", []string{"-container", "-scheme", "eam"}, "decrypt-attack", nil, true},
+  {"container, etm", []string{"-container", "-scheme", "etm"}, "decrypt-attack", nil, false},
+  // the key used as IV, against an oracle that shows what it decrypted
+  {"key as IV", []string{"-iv-key"}, "keyiv-attack", nil, true},
+  {"key as IV, eam", []string{"-iv-key", "-scheme", "eam"}, "keyiv-attack", []string{"-oracle-args", "-iv-key -leak -scheme eam"}, true},
+  {"key as IV, etm", []string{"-iv-key", "-scheme", "etm"}, "keyiv-attack", []string{"-oracle-args", "-iv-key -leak -scheme etm"}, false},
+  // an AES-256 key lends only its first 16 bytes to the IV
+  {"key as IV, AES-256", []string{"-iv-key", "-k", keyStr + keyStr}, "keyiv-attack", []string{"-oracle-args", "-iv-key -leak -k " + keyStr + keyStr}, false},
+}
+
+//routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  runFlag := flag.String("run", "", "only run the cases whose name contains this text")
+  srcFlag := flag.String("src", ".", "directory holding the sources of the programs")
+  flag.Parse()
+  if flag.NArg() != 0 {
+    fmt.Println("usage: go run attack-check.go [-run <text>] [-src <directory>]")
+    os.Exit(1)
+  }
+
+  dir, err := ioutil.TempDir("", "attack-check")
+  check(err)
+  defer os.RemoveAll(dir)
+
+  programs := []string{"encrypt-auth", "decrypt-test"}
+  for _, c := range cases {
+    programs = append(programs, c.attack)
+  }
+  built := map[string]bool{}
+  for _, p := range programs {
+    if built[p] {
+      continue
+    }
+    built[p] = true
+    cmd := exec.Command("go", "build", "-o", filepath.Join(dir, p), p + ".go")
+    cmd.Dir = *srcFlag
+    if out, err := cmd.CombinedOutput(); err != nil {
+      fmt.Printf("cannot build %s: %v\n%s", p, err, out)
+      os.Exit(1)
+    }
+  }
+  err = ioutil.WriteFile(filepath.Join(dir, "plaintext.txt"), []byte(hex.EncodeToString([]byte(plainText))), 0644)
+  check(err)
+
+  failed, total := 0, 0
+  for _, c := range cases {
+    if !strings.Contains(c.name, *runFlag) {
+      continue
+    }
+    total++
+    if problem := runCase(dir, c.encryptArgs, c.attack, c.attackArgs, c.recovers); problem != "" {
+      failed++
+      fmt.Printf("FAIL  %s: %s\n", c.name, problem)
+    } else {
+      fmt.Printf("PASS  %s\n", c.name)
+    }
+  }
+  fmt.Printf("%d of %d attacks end as expected\n", total - failed, total)
+  if failed != 0 {
+    os.Exit(1)
+  }
+}
+
+/*
+Encrypt the plaintext, run `attack` on the ciphertext and compare what it
+writes with the plaintext. Returns what went wrong, or "" when the attack won
+or lost as `recovers` says it should.
+*/
+func runCase(dir string, encryptArgs []string, attack string, attackArgs []string, recovers bool) string {
+  os.Remove(filepath.Join(dir, "restored.txt"))
+  args := append([]string{"encrypt", "-k", keyStr, "-i", "plaintext.txt", "-o", "ciphertext.txt"}, encryptArgs...)
+  if out, err := run(dir, "encrypt-auth", args...); err != nil {
+    return fmt.Sprintf("encrypt-auth: %v\n%s", err, out)
+  }
+  args = append([]string{"-i", "ciphertext.txt", "-o", "restored.txt"}, attackArgs...)
+  out, err := run(dir, attack, args...)
+  restored, _ := ioutil.ReadFile(filepath.Join(dir, "restored.txt"))
+  got, _ := hex.DecodeString(string(restored))
+  won := err == nil && bytes.Equal(got, []byte(plainText))
+  if won && !recovers {
+    return "recovered the plaintext, but should not have"
+  }
+  if !won && recovers {
+    return fmt.Sprintf("did not recover the plaintext (%v), got %q\n%s", err, got, lastLines(out, 5))
+  }
+  return ""
+}
+
+// run a program built into `dir`, from within `dir`
+func run(dir, program string, args ...string) ([]byte, error) {
+  cmd := exec.Command(filepath.Join(dir, program), args...)
+  cmd.Dir = dir
+  return cmd.CombinedOutput()
+}
+
+// the last `n` lines of a program's output, to keep failures readable
+func lastLines(out []byte, n int) string {
+  lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+  if len(lines) > n {
+    lines = lines[len(lines) - n:]
+  }
+  return strings.Join(lines, "\n")
+}
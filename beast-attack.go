@@ -0,0 +1,192 @@
+package main
+
+import (
+  "io/ioutil"
+  "fmt"
+  "os"
+  "encoding/hex"
+  "os/exec"
+  "strings"
+  "flag"
+  "bytes"
+)
+
+/*
+BEAST-style chosen-plaintext attack on CBC with predictable IVs, against
+`encrypt-oracle -mode cbc -iv chained|counter`. With the next IV known in
+advance, the attacker can make the first block of their next message encrypt
+to AES(guess ^ C_prev) for any block C_prev seen before, and so check whether
+the plaintext block behind it was `guess`. Lining up one unknown byte at a time
+at the end of a block, as ecb-attack does, turns that into a byte-by-byte
+recovery of the secret.
+
+Attack described in:
+T. Duong and J. Rizzo, Here Come The XOR Ninjas, 2011.
+*/
+
+// command used to query the encryption oracle, and the extra flags passed to it
+var oracleCmd string
+var oracleArgs []string
+// number of queries made so far
+var queries int
+// the last ciphertext the oracle gave, which the next IV follows from
+var lastCipherText []byte
+// how the oracle picks its IVs: chained or counter
+var ivMode string
+
+// routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  outputFileNameFlag := flag.String ("o", "restored-secret.txt", "output file name")
+  oracleFlag := flag.String ("oracle", "./encrypt-oracle", "encryption oracle program to query")
+  oracleArgsFlag := flag.String ("oracle-args", "-mode cbc -iv chained", "extra flags passed to the oracle program")
+  flag.Parse()
+  oracleCmd = *oracleFlag
+  oracleArgs = strings.Fields(*oracleArgsFlag)
+
+  // two messages in a row show whether the second IV could have been told
+  // from the first message
+  first := queryOracle(nil)
+  second := queryOracle(nil)
+  if len(first) < 32 || len(first) % 16 != 0 {
+    fmt.Println("oracle does not give IV||ciphertext in CBC blocks")
+    os.Exit(1)
+  }
+  if bytes.Equal(second[:16], first[len(first) - 16:]) {
+    ivMode = "chained"
+  } else if bytes.Equal(second[:16], increment(first[:16])) {
+    ivMode = "counter"
+  } else {
+    fmt.Println("IVs look random: the next IV cannot be predicted")
+    os.Exit(1)
+  }
+  // the IV makes up the first block, and the secret grows the rest like with
+  // ecb-attack
+  base := len(second) - 16
+  secretLen := 0
+  for i := 1; i <= 16; i++ {
+    if len(queryOracle(bytes.Repeat([]byte{'A'}, i))) - 16 > base {
+      secretLen = base - i
+      break
+    }
+  }
+  fmt.Printf("iv: %s, secret length: %d\n", ivMode, secretLen)
+
+  secret := recoverSecret(secretLen)
+  fmt.Printf("recovered %d bytes in %d queries\n", len(secret), queries)
+  outputContent := make([]byte, hex.EncodedLen(len(secret)))
+  hex.Encode(outputContent, secret)
+  ioutil.WriteFile(*outputFileNameFlag, outputContent, 0644)
+}
+
+/*
+Main function for the attack. Byte i of the secret is moved to the end of
+plaintext block j by a filler, and the message is encrypted once:
+  C_j = AES(P_j ^ C_(j-1))
+with C_(-1) the IV. The first 15 bytes of P_j are filler or known secret, so
+for each guess of the last byte a one-block message
+  guess ^ C_(j-1) ^ nextIV
+is sent, which encrypts to AES(guess ^ C_(j-1)): C_j exactly when the guess is
+right. Printable characters are tried first.
+*/
+func recoverSecret(secretLen int) []byte {
+  var secret []byte
+  // the oracle's answer to each length of filler, asked for only once
+  targets := make(map[int][]byte)
+  for i := 0; i < secretLen; i++ {
+    fillerLen := 15 - i % 16
+    filler := bytes.Repeat([]byte{'A'}, fillerLen)
+    if targets[fillerLen] == nil {
+      targets[fillerLen] = queryOracle(filler)
+    }
+    // IV||C', so block j of the plaintext is block j + 1 here
+    j := i / 16
+    prev, target := targets[fillerLen][16 * j : 16 * j + 16], targets[fillerLen][16 * j + 16 : 16 * j + 32]
+    known := append(filler, secret...)
+    guess := make([]byte, 16)
+    copy(guess, known[len(known) - 15:])
+
+    found := false
+    for _, b := range guessOrder() {
+      guess[15] = b
+      nextIV := predictIV()
+      query := make([]byte, 16)
+      for k := range query {
+        query[k] = guess[k] ^ prev[k] ^ nextIV[k]
+      }
+      if bytes.Equal(queryOracle(query)[16:32], target) {
+        found = true
+        break
+      }
+    }
+    if !found {
+      fmt.Println()
+      fmt.Println("Attack failed: no guess matched byte", i)
+      os.Exit(1)
+    }
+    secret = append(secret, guess[15])
+    fmt.Printf(".")
+  }
+  fmt.Println()
+  return secret
+}
+
+// all byte values, printable ASCII first
+func guessOrder() []byte {
+  var order []byte
+  for b := 0x20; b < 0x7f; b++ {
+    order = append(order, byte(b))
+  }
+  for b := 0; b < 0x100; b++ {
+    if b < 0x20 || b >= 0x7f {
+      order = append(order, byte(b))
+    }
+  }
+  return order
+}
+
+// the IV the oracle will use for the next message
+func predictIV() []byte {
+  if ivMode == "chained" {
+    return lastCipherText[len(lastCipherText) - 16:]
+  }
+  return increment(lastCipherText[:16])
+}
+
+// `block` plus one, as a 128-bit big-endian integer
+func increment(block []byte) []byte {
+  res := make([]byte, 16)
+  copy(res, block)
+  for j := 15; j >= 0; j-- {
+    res[j]++
+    if res[j] != 0 {
+      break
+    }
+  }
+  return res
+}
+
+/*
+Submit `input` to the oracle and return the ciphertext. The input is written
+hex formatted into test.txt, which is handed to the oracle program, and the
+ciphertext comes back hex formatted on its output.
+*/
+func queryOracle(input []byte) []byte {
+  ioutil.WriteFile("test.txt", []byte(hex.EncodeToString(input)), 0644)
+  args := append([]string{"-i", "test.txt"}, oracleArgs...)
+  out, err := exec.Command(oracleCmd, args...).CombinedOutput()
+  check(err)
+  queries++
+  cipherText, err := hex.DecodeString(strings.TrimSpace(string(out)))
+  if err != nil {
+    fmt.Printf("oracle gave no ciphertext: %s\n", out)
+    os.Exit(1)
+  }
+  lastCipherText = cipherText
+  return cipherText
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+  "io/ioutil"
+  "fmt"
+  "os"
+  "encoding/hex"
+  "crypto/rand"
+  "math/big"
+  "os/exec"
+  "sort"
+  "strings"
+  "flag"
+  "bytes"
+  "time"
+)
+
+/*
+Bleichenbacher's 1998 attack on RSA PKCS #1 v1.5 encryption, run against the
+`rsa-oracle` program the same way `decrypt-attack` runs against `decrypt-test`.
+The ciphertext file is HEX formatted; the public key is asked from the oracle
+program with -pubkey, since it is public anyway.
+
+Algorithm from:
+D. Bleichenbacher, Chosen Ciphertext Attacks Against Protocols Based on the
+RSA Encryption Standard PKCS #1, CRYPTO '98.
+*/
+
+// command used to query the padding oracle, and the extra flags passed to it
+var oracleCmd string
+var oracleArgs []string
+// how many times the oracle gave each response
+var responses = make(map[string]int)
+// time spent waiting for the oracle, over all queries
+var queryTime time.Duration
+// the public key, and the length of the modulus in bytes
+var n, e *big.Int
+var k int
+
+// an interval [a, b] the plaintext is known to lie in
+type interval struct {
+  a, b *big.Int
+}
+
+// routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  inputFileNameFlag := flag.String ("i", "ciphertext.txt", "input file name")
+  outputFileNameFlag := flag.String ("o", "restored-plaintext.txt", "output file name")
+  oracleFlag := flag.String ("oracle", "./rsa-oracle", "oracle program to query")
+  oracleArgsFlag := flag.String ("oracle-args", "", `extra flags passed to the oracle program, e.g. "-check prefix"`)
+  flag.Parse()
+  oracleCmd = *oracleFlag
+  oracleArgs = strings.Fields(*oracleArgsFlag)
+
+  data, err := ioutil.ReadFile(*inputFileNameFlag)
+  if err != nil {
+    fmt.Printf ("input file %s does not exit!\n", *inputFileNameFlag)
+    os.Exit(1)
+  }
+  cipherText, err := hex.DecodeString(strings.TrimSpace(string(data)))
+  if err != nil {
+    fmt.Println("Invalid Input File")
+    os.Exit(1)
+  }
+  readPublicKey()
+  c := new(big.Int).SetBytes(cipherText)
+  if len(cipherText) != k || c.Cmp(n) >= 0 {
+    fmt.Println("Invalid Input File")
+    os.Exit(1)
+  }
+
+  start := time.Now()
+  m := attack(c)
+  fmt.Println()
+  EM := m.FillBytes(make([]byte, k))
+  sep := bytes.IndexByte(EM[2:], 0)
+  if EM[0] != 0x00 || EM[1] != 0x02 || sep < 0 {
+    fmt.Println("Attack failed: recovered plaintext has no valid padding")
+    printResponses()
+    os.Exit(1)
+  }
+  res := EM[2 + sep + 1:]
+  fmt.Printf("recovered %d bytes in %d queries, %v\n", len(res), queryCount(), time.Since(start).Round(time.Millisecond))
+
+  outputContent := make([]byte, hex.EncodedLen(len(res)))
+  hex.Encode(outputContent, res)
+  ioutil.WriteFile(*outputFileNameFlag, outputContent, 0644)
+}
+
+/*
+Main function for the attack. A conforming plaintext m starts with 0x00 0x02,
+i.e. 2B <= m < 3B with B = 2^(8(k - 2)). Multiplying the ciphertext by s^e
+multiplies the plaintext by s, so every s for which the oracle accepts
+c * s^e tells that m * s mod n lies in [2B, 3B) as well. Each such s cuts
+down the set of intervals m can be in, until a single value is left.
+*/
+func attack(c *big.Int) *big.Int {
+  B := new(big.Int).Lsh(big.NewInt(1), uint(8 * (k - 2)))
+  B2 := new(big.Int).Mul(big.NewInt(2), B)
+  B3 := new(big.Int).Mul(big.NewInt(3), B)
+
+  // Step 1, blinding: find s0 with c * s0^e conforming. A ciphertext from a
+  // PKCS #1 v1.5 encryption already is, so s0 = 1 is tried first
+  s0 := big.NewInt(1)
+  for !conforming(c, s0) {
+    s0 = randomInt()
+  }
+  c0 := multiply(c, s0)
+  M := []interval{{new(big.Int).Set(B2), new(big.Int).Sub(B3, big.NewInt(1))}}
+
+  // Step 2a: the smallest s that can push m * s past n into [2B, 3B) again
+  s := ceilDiv(n, B3)
+  for !conforming(c0, s) {
+    s.Add(s, big.NewInt(1))
+  }
+  // bytes of the plaintext pinned down so far, one dot each
+  known := 0
+  for {
+    // Step 3: narrow the intervals down with the latest s
+    M = narrow(M, s, B2, B3)
+    if len(M) == 0 {
+      fmt.Println()
+      fmt.Println("Attack failed: no interval left, the oracle accepted a non-conforming plaintext")
+      printResponses()
+      os.Exit(1)
+    }
+    if len(M) == 1 {
+      width := new(big.Int).Sub(M[0].b, M[0].a)
+      for ; known < k - (width.BitLen() + 7) / 8; known++ {
+        fmt.Printf(".")
+      }
+    }
+    // Step 4: done when one value is left
+    if len(M) == 1 && M[0].a.Cmp(M[0].b) == 0 {
+      m := new(big.Int).ModInverse(s0, n)
+      m.Mul(m, M[0].a)
+      return m.Mod(m, n)
+    }
+    if len(M) > 1 {
+      // Step 2b: several intervals left, search on from the last s
+      s.Add(s, big.NewInt(1))
+      for !conforming(c0, s) {
+        s.Add(s, big.NewInt(1))
+      }
+    } else {
+      s = searchOneInterval(c0, M[0], s, B2, B3)
+    }
+  }
+}
+
+/*
+Step 2c: with one interval [a, b] left, try the values of s that would map the
+whole interval into [2B, 3B) for increasing wrap-arounds r. This roughly halves
+the interval with each conforming s found.
+*/
+func searchOneInterval(c0 *big.Int, m interval, s, B2, B3 *big.Int) *big.Int {
+  // r >= 2 (b * s - 2B) / n
+  r := new(big.Int).Mul(m.b, s)
+  r.Sub(r, B2)
+  r.Lsh(r, 1)
+  r = ceilDiv(r, n)
+  for ; ; r.Add(r, big.NewInt(1)) {
+    rn := new(big.Int).Mul(r, n)
+    // (2B + r n) / b <= s < (3B + r n) / a
+    lo := ceilDiv(new(big.Int).Add(B2, rn), m.b)
+    hi := ceilDiv(new(big.Int).Add(B3, rn), m.a)
+    for s := lo; s.Cmp(hi) < 0; s.Add(s, big.NewInt(1)) {
+      if conforming(c0, s) {
+        return s
+      }
+    }
+  }
+}
+
+/*
+Step 3: keep the parts of each interval in `M` that s maps into [2B, 3B) after
+r wrap-arounds, for every r possible. Overlapping results are merged.
+*/
+func narrow(M []interval, s, B2, B3 *big.Int) []interval {
+  var res []interval
+  B3m1 := new(big.Int).Sub(B3, big.NewInt(1))
+  for _, m := range M {
+    // (a s - 3B + 1) / n <= r <= (b s - 2B) / n
+    r := new(big.Int).Mul(m.a, s)
+    r.Sub(r, B3m1)
+    r = ceilDiv(r, n)
+    rhi := new(big.Int).Mul(m.b, s)
+    rhi.Sub(rhi, B2)
+    rhi.Div(rhi, n)
+    for ; r.Cmp(rhi) <= 0; r.Add(r, big.NewInt(1)) {
+      rn := new(big.Int).Mul(r, n)
+      a := ceilDiv(new(big.Int).Add(B2, rn), s)
+      if a.Cmp(m.a) < 0 {
+        a.Set(m.a)
+      }
+      b := new(big.Int).Add(B3m1, rn)
+      b.Div(b, s)
+      if b.Cmp(m.b) > 0 {
+        b.Set(m.b)
+      }
+      if a.Cmp(b) <= 0 {
+        res = append(res, interval{a, b})
+      }
+    }
+  }
+  sort.Slice(res, func(i, j int) bool {
+    return res[i].a.Cmp(res[j].a) < 0
+  })
+  merged := res[:0]
+  for _, m := range res {
+    last := len(merged) - 1
+    if last >= 0 && m.a.Cmp(merged[last].b) <= 0 {
+      if m.b.Cmp(merged[last].b) > 0 {
+        merged[last].b = m.b
+      }
+      continue
+    }
+    merged = append(merged, m)
+  }
+  return merged
+}
+
+// c * s^e mod n, the ciphertext of the plaintext multiplied by s
+func multiply(c, s *big.Int) *big.Int {
+  res := new(big.Int).Exp(s, e, n)
+  res.Mul(res, c)
+  return res.Mod(res, n)
+}
+
+// whether the oracle takes c * s^e for conforming
+func conforming(c, s *big.Int) bool {
+  return !strings.Contains(queryOracle(multiply(c, s).FillBytes(make([]byte, k))), "INVALID PADDING")
+}
+
+// ceil(x / y) for y > 0. big.Int's Div rounds down for a positive divisor
+func ceilDiv(x, y *big.Int) *big.Int {
+  res := new(big.Int).Add(x, y)
+  res.Sub(res, big.NewInt(1))
+  return res.Div(res, y)
+}
+
+// a random blinding factor in [2, n)
+func randomInt() *big.Int {
+  res, err := rand.Int(rand.Reader, new(big.Int).Sub(n, big.NewInt(2)))
+  check(err)
+  return res.Add(res, big.NewInt(2))
+}
+
+/*
+Ask the oracle program for its public key, printed as "n: <hex>" and "e: <hex>"
+lines.
+*/
+func readPublicKey() {
+  args := append([]string{"-pubkey"}, oracleArgs...)
+  out, err := exec.Command(oracleCmd, args...).CombinedOutput()
+  check(err)
+  headers, _ := parseHeaders(out)
+  var ok1, ok2 bool
+  n, ok1 = new(big.Int).SetString(headers["n"], 16)
+  e, ok2 = new(big.Int).SetString(headers["e"], 16)
+  if !ok1 || !ok2 {
+    fmt.Println("oracle gave no public key")
+    os.Exit(1)
+  }
+  k = (n.BitLen() + 7) / 8
+}
+
+/*
+Submit `query` to the oracle and return its response message. The query is
+written hex formatted into test.txt, which is handed to the oracle program.
+*/
+func queryOracle(query []byte) string {
+  outputToFile := make([]byte, hex.EncodedLen(len(query)))
+  hex.Encode(outputToFile, query)
+  ioutil.WriteFile("test.txt", outputToFile, 0644)
+
+  args := append([]string{"-i", "test.txt"}, oracleArgs...)
+  start := time.Now()
+  out, err := exec.Command(oracleCmd, args...).CombinedOutput()
+  queryTime += time.Since(start)
+  check(err)
+  responses[string(out)]++
+  return string(out)
+}
+
+// number of queries made so far
+func queryCount() int {
+  queries := 0
+  for _, count := range responses {
+    queries += count
+  }
+  return queries
+}
+
+// print how often the oracle gave each response
+func printResponses() {
+  fmt.Println("oracle responses:")
+  for response, count := range responses {
+    fmt.Printf("  %-24s %d\n", response, count)
+  }
+}
+
+/*
+Split the "Name: value" header lines off the front of `data`. Returns the
+headers found and the rest.
+*/
+func parseHeaders(data []byte) (map[string]string, []byte) {
+  headers := make(map[string]string)
+  for {
+    end := bytes.IndexByte(data, '\n')
+    if end < 0 {
+      break
+    }
+    line := string(data[:end])
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+      break
+    }
+    headers[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon + 1:])
+    data = data[end + 1:]
+  }
+  return headers, data
+}
@@ -0,0 +1,111 @@
+package main
+
+/*
+  CBC bit-flipping: edit a ciphertext so that a known piece of its plaintext
+  decrypts to something else, without knowing the key.
+  USAGE: $ go run cbc-bitflip.go -i <ciphertext file> -o <output file> -offset <n> -from <text> -to <text>
+  flags: offset: where the known piece starts in the plaintext, in bytes.
+         from  : the known piece of plaintext.
+         to    : what it should read instead, same length as `from`.
+  The files are in the IV||ciphertext format of encrypt-auth, headers included,
+  and the headers are copied over to the output untouched.
+*/
+
+import (
+  "io/ioutil"
+  "fmt"
+  "os"
+  "encoding/hex"
+  "strings"
+  "flag"
+  "bytes"
+)
+
+//routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  inputFileNameFlag := flag.String("i", "ciphertext.txt", "input file name")
+  outputFileNameFlag := flag.String("o", "flipped-ciphertext.txt", "output file name")
+  offsetFlag := flag.Int("offset", -1, "where the known piece starts in the plaintext, in bytes")
+  fromFlag := flag.String("from", "", "the known piece of plaintext")
+  toFlag := flag.String("to", "", "what the piece should read instead, same length as -from")
+  flag.Parse()
+  from, to, offset := []byte(*fromFlag), []byte(*toFlag), *offsetFlag
+  if flag.NArg() != 0 || offset < 0 || len(from) == 0 || len(from) != len(to) {
+    fmt.Println("-offset, -from and -to are needed, and -to has to be as long as -from")
+    os.Exit(1)
+  }
+
+  data, err := ioutil.ReadFile(*inputFileNameFlag)
+  if err != nil {
+    fmt.Printf("input file %s does not exist!\n", *inputFileNameFlag)
+    os.Exit(1)
+  }
+  headers, rest := parseHeaders(data)
+  headerLines := data[:len(data) - len(rest)]
+  if headers["Scheme"] == "gcm" || headers["Mode"] != "" && headers["Mode"] != "cbc" {
+    fmt.Println("Only CBC ciphertexts can be edited this way")
+    os.Exit(1)
+  }
+  cipherTextWithIV, err := hex.DecodeString(strings.TrimSpace(string(rest)))
+  if err != nil || len(cipherTextWithIV) < 32 || len(cipherTextWithIV) % 16 != 0 && headers["Scheme"] != "etm" && headers["Scheme"] != "eam" {
+    fmt.Println("Invalid Input File")
+    os.Exit(1)
+  }
+
+  // Plaintext block j is aes-dec(C_j) xor C_(j-1), with C_0 being the IV, so
+  // byte p of the plaintext is xor-ed with byte p of IV||C'. Flipping that
+  // byte flips the plaintext byte the same way. The edited ciphertext block
+  // itself decrypts to garbage, so the piece has to sit within one block for
+  // the edits not to garble each other
+  block := offset / 16
+  if (offset + len(from) - 1) / 16 != block {
+    fmt.Println("The piece has to sit within one 16-byte block of the plaintext")
+    os.Exit(1)
+  }
+  if offset + len(from) > len(cipherTextWithIV) - 16 {
+    fmt.Println("The piece lies beyond the end of the ciphertext")
+    os.Exit(1)
+  }
+  for i := range from {
+    cipherTextWithIV[offset + i] ^= from[i] ^ to[i]
+  }
+  if block == 0 {
+    fmt.Printf("edited bytes %d to %d of the IV, nothing else changes\n", offset, offset + len(from) - 1)
+  } else {
+    fmt.Printf("edited bytes %d to %d of block %d of IV||ciphertext, plaintext block %d (bytes %d to %d) decrypts to garbage now\n",
+      offset % 16, (offset + len(from) - 1) % 16, block, block - 1, (block - 1) * 16, block * 16 - 1)
+  }
+
+  outputContent := make([]byte, hex.EncodedLen(len(cipherTextWithIV)))
+  hex.Encode(outputContent, cipherTextWithIV)
+  err = ioutil.WriteFile(*outputFileNameFlag, append(headerLines, outputContent...), 0644)
+  check(err)
+}
+
+/*
+Split the "Name: value" header lines that encrypt-auth writes off the front of
+a file. Returns the headers found and the rest of the file.
+*/
+func parseHeaders(data []byte) (map[string]string, []byte) {
+  headers := make(map[string]string)
+  for {
+    end := bytes.IndexByte(data, '\n')
+    if end < 0 {
+      break
+    }
+    line := string(data[:end])
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+      break
+    }
+    headers[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon + 1:])
+    data = data[end + 1:]
+  }
+  return headers, data
+}
@@ -7,26 +7,57 @@ package main
                 you have to pass in this flag like -tohex=f with explicit `=` due to Go's requirement of boolean flag.
          i    : input file name.
          o    : output file name.
+         armor: wrap a HEX formatted ciphertext file, header lines and all, in ASCII armor. An armored input file is
+                always turned back into header lines and HEX, whatever the other flags say.
 */
 
 import (
   "io/ioutil"
   "fmt"
   "encoding/hex"
+  "encoding/base64"
   "flag"
   "os"
+  "strings"
+  "bytes"
 )
 
+// the lines an armored file starts and ends with, see `armor`
+const armorBegin string = "-----BEGIN ENCRYPT-AUTH MESSAGE-----"
+const armorEnd string = "-----END ENCRYPT-AUTH MESSAGE-----"
+
 func main() {
   toHex := flag.Bool ("tohex", true, `a bool, defaults to true, convert the input file to hex if true, convert the input file from hex into readable text if false`)
   inputFile := flag.String ("i", "input.txt", `a string, defaults to input.txt, corresponds to the file that contains human-readable plaintext.`)
   outputFile := flag.String ("o", "plaintext.txt", `a string, defaults to plaintext.txt, corresponds to the name of the file to output hex formatted plaintext`)
+  armorFlag := flag.Bool ("armor", false, `a bool, defaults to false, wrap the hex formatted ciphertext file, headers and all, in ASCII armor`)
   flag.Parse()
   data, err := ioutil.ReadFile (*inputFile)
   if err != nil {
     fmt.Printf ("%s does not exist!\n", *inputFile)
     os.Exit(1)
   }
+  if dearmored := dearmor(data); !bytes.Equal(dearmored, data) {
+    ioutil.WriteFile(*outputFile, dearmored, 0644)
+    return
+  }
+  if *armorFlag {
+    // the header lines go into the armor as they are
+    _, rest := parseHeaders(data)
+    body, err := hex.DecodeString(strings.TrimSpace(string(rest)))
+    if err != nil {
+      fmt.Printf ("%s is not a hex formatted ciphertext file!\n", *inputFile)
+      os.Exit(1)
+    }
+    var headerLines []string
+    for _, line := range strings.Split(string(data[:len(data) - len(rest)]), "\n") {
+      if line != "" {
+        headerLines = append(headerLines, line)
+      }
+    }
+    ioutil.WriteFile(*outputFile, armor(headerLines, body), 0644)
+    return
+  }
   var inputText []byte
   if !*toHex {
     inputText = make([]byte, hex.DecodedLen(len(data)))
@@ -42,4 +73,112 @@ func main() {
     outputText = inputText
   }
   ioutil.WriteFile(*outputFile, outputText, 0644)
-}
\ No newline at end of file
+}
+
+/*
+CRC-24 of OpenPGP (RFC 4880, section 6.1), the checksum at the foot of an
+armored file.
+*/
+func crc24(data []byte) uint32 {
+  crc := uint32(0xb704ce)
+  for _, b := range data {
+    crc ^= uint32(b) << 16
+    for i := 0; i < 8; i++ {
+      crc <<= 1
+      if crc & 0x1000000 != 0 {
+        crc ^= 0x1864cfb
+      }
+    }
+  }
+  return crc & 0xffffff
+}
+
+/*
+Wrap `body` in ASCII armor, laid out like OpenPGP's: the BEGIN line, the
+`headers`, a blank line, the body in base64 64 characters to a line, its CRC-24
+in base64 after a "=", and the END line. Unlike one long line of hex, this
+survives being pasted into a mail or a chat.
+*/
+func armor(headers []string, body []byte) []byte {
+  var buf bytes.Buffer
+  buf.WriteString(armorBegin + "\n")
+  for _, header := range headers {
+    buf.WriteString(header + "\n")
+  }
+  buf.WriteString("\n")
+  encoded := base64.StdEncoding.EncodeToString(body)
+  for len(encoded) > 64 {
+    buf.WriteString(encoded[:64] + "\n")
+    encoded = encoded[64:]
+  }
+  if encoded != "" {
+    buf.WriteString(encoded + "\n")
+  }
+  crc := crc24(body)
+  buf.WriteString("=" + base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) + "\n")
+  buf.WriteString(armorEnd + "\n")
+  return buf.Bytes()
+}
+
+/*
+Turn an armored file back into header lines followed by hex, the form the rest
+of the program reads. Anything else is returned as it is. Exits when the armor
+is broken or the checksum does not match, which is what a line lost or mangled
+in pasting looks like.
+*/
+func dearmor(data []byte) []byte {
+  text := strings.TrimSpace(strings.Replace(string(data), "\r\n", "\n", -1))
+  if !strings.HasPrefix(text, armorBegin + "\n") {
+    return data
+  }
+  lines := strings.Split(text, "\n")
+  if lines[len(lines) - 1] != armorEnd {
+    fmt.Println("Input file is armored but has no END line.")
+    os.Exit(1)
+  }
+  lines = lines[1 : len(lines) - 1]
+  // the headers run up to the first blank line
+  var res []byte
+  i := 0
+  for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+    res = append(res, lines[i] + "\n"...)
+  }
+  var body, checksum string
+  for _, line := range lines[i:] {
+    line = strings.TrimSpace(line)
+    if strings.HasPrefix(line, "=") {
+      checksum = line[1:]
+    } else {
+      body += line
+    }
+  }
+  raw, err := base64.StdEncoding.DecodeString(body)
+  sum, errSum := base64.StdEncoding.DecodeString(checksum)
+  if err != nil || errSum != nil || len(sum) != 3 || crc24(raw) != uint32(sum[0]) << 16 | uint32(sum[1]) << 8 | uint32(sum[2]) {
+    fmt.Println("Input file is armored, but its body does not match the checksum.")
+    os.Exit(1)
+  }
+  return append(res, hex.EncodeToString(raw)...)
+}
+
+/*
+Split the "Name: value" header lines that encrypt-auth writes off the front of
+a file. Returns the headers found and the rest of the file.
+*/
+func parseHeaders(data []byte) (map[string]string, []byte) {
+  headers := make(map[string]string)
+  for {
+    end := bytes.IndexByte(data, '\n')
+    if end < 0 {
+      break
+    }
+    line := string(data[:end])
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+      break
+    }
+    headers[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon + 1:])
+    data = data[end + 1:]
+  }
+  return headers, data
+}
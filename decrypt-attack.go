@@ -5,11 +5,14 @@ import (
   "fmt"
   "os"
   "encoding/hex"
+  "encoding/base64"
   "crypto/rand"
   "os/exec"
   "strings"
   "strconv"
   "flag"
+  "bytes"
+  "time"
 )
 
 /*
@@ -25,6 +28,34 @@ Algorithm inspired by:
 https://robertheaton.com/2013/07/29/padding-oracle-attack/
 */
 
+// command used to query the padding oracle, and the extra flags passed to it
+var oracleCmd string
+var oracleArgs []string
+// bytes appended to every query, i.e. the tag that etm and eam ciphertexts
+// carry in the clear
+var querySuffix []byte
+// padding scheme the oracle validates: pkcs7, x923 or iso7816
+var paddingScheme string
+// how the oracle validates pkcs7 padding, see decrypt-test
+var paddingCheck string
+// how many times the oracle gave each response, shown when the attack fails
+var responses = make(map[string]int)
+// time spent waiting for the oracle, over all queries
+var queryTime time.Duration
+// bytes written to the oracle's input file, over all queries
+var queryBytes int
+// whether only the block pair under attack is sent, instead of the whole
+// ciphertext
+var shortQueries bool
+// the magic and version that start a container, see `checkContainer`. Version
+// 2 tags mte messages over the associated data length even when there is no
+// associated data, which version 1 left out
+const containerMagic string = "encrypt-auth"
+const containerVersion int = 2
+// the lines an armored file starts and ends with, see `dearmor`
+const armorBegin string = "-----BEGIN ENCRYPT-AUTH MESSAGE-----"
+const armorEnd string = "-----END ENCRYPT-AUTH MESSAGE-----"
+
 // routine for error handling
 func check(e error) {
   if e != nil {
@@ -35,8 +66,21 @@ func check(e error) {
 func main() {
   inputFileNameFlag := flag.String ("i", "ciphertext.txt", "input file name")
   outputFileNameFlag := flag.String ("o", "restored-plaintext.txt", "output file name")
+  oracleFlag := flag.String ("oracle", "./decrypt-test", "oracle program to query")
+  oracleArgsFlag := flag.String ("oracle-args", "", `extra flags passed to the oracle program, e.g. "-hardened"`)
+  schemeFlag := flag.String ("scheme", "", "scheme of the ciphertext: mte, etm, eam, gcm or none. Defaults to the scheme recorded in the input file, or mte")
+  paddingFlag := flag.String ("padding", "", "padding scheme the oracle validates: pkcs7, x923, iso7816, iso10126 or zero. Defaults to the padding recorded in the input file, or pkcs7")
+  checkFlag := flag.String ("check", "strict", "how the oracle validates pkcs7 padding: strict, allow-zero, no-upper-bound, first-last or last-byte")
+  queryFlag := flag.String ("query", "auto", "what each query holds: full (the whole ciphertext), short (only the two blocks under attack) or auto (short if the oracle accepts it)")
+  probeFlag := flag.Bool ("probe", false, "fingerprint the oracle instead of attacking it, and write the suggested attack configuration to the -config file, attack.conf by default")
+  configFlag := flag.String ("config", "", `attack configuration file of "name = value" lines, as written by -probe. Flags given on the command line take precedence`)
 
   flag.Parse()
+  if *configFlag != "" && !*probeFlag {
+    loadConfig(*configFlag)
+  }
+  oracleCmd = *oracleFlag
+  oracleArgs = strings.Fields(*oracleArgsFlag)
 
   // read in file into a byte slice
   inputFile := *inputFileNameFlag
@@ -45,7 +89,33 @@ func main() {
     fmt.Printf ("input file %s does not exit!\n", inputFile)
     os.Exit(1)
   }
-
+  // the armor and the header, container or not, are stripped here, and the
+  // attack goes on with the bare ciphertext
+  data = dearmor(data)
+  headers, data := parseHeaders(data)
+  checkContainer(headers)
+  scheme := *schemeFlag
+  if scheme == "" {
+    scheme = headers["Scheme"]
+  }
+  if scheme == "" {
+    scheme = "mte"
+  }
+  // the query files carry no headers, so the oracle is told what the input
+  // file records. -oracle-args come after and can still override it
+  forwarded := []string{"-scheme", scheme}
+  if headers["Mode"] != "" {
+    forwarded = append(forwarded, "-mode", headers["Mode"])
+  }
+  if *paddingFlag != "" {
+    forwarded = append(forwarded, "-padding", *paddingFlag)
+  } else if headers["Padding"] != "" {
+    forwarded = append(forwarded, "-padding", headers["Padding"])
+  }
+  if headers["MAC"] != "" {
+    forwarded = append(forwarded, "-mac", headers["MAC"])
+  }
+  oracleArgs = append(forwarded, oracleArgs...)
   // try to decode the file content as hex format first
   cipherTextWithIV := make([]byte, hex.DecodedLen(len(data)))
   _, err = hex.Decode(cipherTextWithIV, data)
@@ -60,6 +130,110 @@ func main() {
       cipherTextWithIV[i] = byte(val)
     }
   }
+
+  // length of the tag hidden inside the plaintext
+  innerTagLen := 32
+  if scheme == "etm" || scheme == "eam" {
+    // the tag travels after the ciphertext, so it is left in place in every
+    // query while the blocks in front of it are attacked
+    if len(cipherTextWithIV) < 64 {
+      fmt.Println("Invalid Input File")
+      os.Exit(1)
+    }
+    n := len(cipherTextWithIV)
+    cipherTextWithIV, querySuffix = cipherTextWithIV[:n - 32], cipherTextWithIV[n - 32:]
+    innerTagLen = 0
+  }
+  if scheme == "gcm" {
+    // nonce||ciphertext||tag has no block structure to speak of. The oracle is
+    // still probed, keeping the 16-byte tag in place, to show what it says
+    if len(cipherTextWithIV) < 48 {
+      fmt.Println("Invalid Input File")
+      os.Exit(1)
+    }
+    n := len(cipherTextWithIV)
+    cipherTextWithIV, querySuffix = cipherTextWithIV[:n - 16], cipherTextWithIV[n - 16:]
+    innerTagLen = 0
+  }
+  if scheme == "none" {
+    // no tag anywhere, the padding is all the oracle checks
+    innerTagLen = 0
+  }
+  if len(cipherTextWithIV) < 32 {
+    fmt.Println("Invalid Input File")
+    os.Exit(1)
+  }
+  if *probeFlag {
+    configFile := *configFlag
+    if configFile == "" {
+      configFile = "attack.conf"
+    }
+    probe(cipherTextWithIV, scheme, *oracleArgsFlag, configFile)
+    return
+  }
+
+  paddingScheme = *paddingFlag
+  if paddingScheme == "" {
+    paddingScheme = headers["Padding"]
+  }
+  if paddingScheme == "" {
+    paddingScheme = "pkcs7"
+  }
+  switch paddingScheme {
+  case "pkcs7", "x923", "iso7816":
+  case "iso10126":
+    fmt.Println("ISO 10126 padding is random apart from its last byte, so the oracle can only confirm the last byte of each block. The rest of the plaintext cannot be recovered")
+    os.Exit(1)
+  case "zero":
+    fmt.Println("Zero padding can never be invalid, so there is no padding oracle to attack")
+    os.Exit(1)
+  default:
+    fmt.Println("Unknown padding scheme", paddingScheme)
+    os.Exit(1)
+  }
+  paddingCheck = *checkFlag
+  switch paddingCheck {
+  case "strict", "no-upper-bound", "first-last":
+    // the attack only ever aims for paddings of at most 16 bytes, and sets
+    // every byte of them, so these validators accept the same guesses
+  case "allow-zero":
+    // a last byte of 0x00 passes as well as 0x01, which is sorted out
+    // while recovering the byte in front of it
+  case "last-byte":
+    fmt.Println("An oracle that only checks the last byte leaks nothing but the last byte of each block. The rest of the plaintext cannot be recovered")
+    os.Exit(1)
+  default:
+    fmt.Println("Unknown padding check", paddingCheck)
+    os.Exit(1)
+  }
+  if paddingCheck != "strict" && paddingScheme != "pkcs7" {
+    fmt.Println("-check only applies to pkcs7 padding")
+    os.Exit(1)
+  }
+  if *queryFlag != "full" && *queryFlag != "short" && *queryFlag != "auto" {
+    fmt.Println("Unknown query type", *queryFlag)
+    os.Exit(1)
+  }
+
+
+  // make sure there is a padding oracle to attack at all before spending
+  // thousands of queries on it
+  if !paddingSensitive(cipherTextWithIV) {
+    fmt.Println("oracle not padding-sensitive: no probe produced a padding error")
+    printResponses()
+    os.Exit(1)
+  }
+  n := len(cipherTextWithIV)
+  shortQueries = *queryFlag == "short" || *queryFlag == "auto" && acceptsTwoBlocks(cipherTextWithIV)
+  if *queryFlag == "auto" && !shortQueries {
+    fmt.Println("oracle rejects two-block queries, sending the full ciphertext")
+  }
+  // time both kinds of query up front, to tell what the short ones saved
+  var fullLatency time.Duration
+  if shortQueries && n > 32 {
+    fullLatency = averageLatency(cipherTextWithIV, 8)
+  }
+  queriesBefore, timeBefore, bytesBefore := queryCount(), queryTime, queryBytes
   
   // parsing the file content into IV and the cipherText
   IV, cipherText := cipherTextWithIV[:16], cipherTextWithIV[16:]
@@ -71,8 +245,36 @@ func main() {
     os.Exit(1)
   }
   guessRes := guess(IV, cipherText)
-  padLen := int(guessRes[len(guessRes) - 1])
-  res := guessRes[:len(guessRes) - padLen - 32]
+  if shortQueries && n > 32 {
+    queries := queryCount() - queriesBefore
+    fullBytes := queries * hex.EncodedLen(n + len(querySuffix))
+    sentBytes := queryBytes - bytesBefore
+    fmt.Printf("two-block queries: %d bytes written instead of %d (%.0f%% less), %v spent on queries instead of about %v\n",
+      sentBytes, fullBytes, 100 - 100 * float64(sentBytes) / float64(fullBytes),
+      (queryTime - timeBefore).Round(time.Millisecond), (fullLatency * time.Duration(queries)).Round(time.Millisecond))
+  }
+  // every guess is taken as right by an oracle that never reports a padding
+  // error, so the "recovered" plaintext is meaningless
+  paddingErrors := 0
+  for response, count := range responses {
+    if strings.Contains(response, "INVALID PADDING") {
+      paddingErrors += count
+    }
+  }
+  if paddingErrors == 0 {
+    fmt.Println("Attack failed: the oracle never reported a padding error")
+    printResponses()
+    os.Exit(1)
+  }
+  padLen := paddingLength(guessRes)
+  // an oracle that does not leak padding errors makes every guess look right,
+  // which shows up as garbage padding at the end
+  if padLen == 0 || padLen + innerTagLen > len(guessRes) {
+    fmt.Println("Attack failed: recovered plaintext has no valid padding")
+    printResponses()
+    os.Exit(1)
+  }
+  res := guessRes[:len(guessRes) - padLen - innerTagLen]
 
   outputFile := *outputFileNameFlag
   outputContent := make ([]byte, hex.EncodedLen (len (res)))
@@ -84,7 +286,8 @@ func main() {
 /*
 Main function for the attack. In turn and starting from the tail, copy two 
 consecutive blocks to the tail of the ciphertext so that they can be analyzed
-with padding oracle attack. Refer to README for more information.
+with padding oracle attack. With `shortQueries`, the pair is sent on its own.
+Refer to README for more information.
 */
 func guess(IV, cipherText []byte) []byte {
   cipherText = append(IV, cipherText...)
@@ -99,8 +302,14 @@ func guess(IV, cipherText []byte) []byte {
     // Move new block-pair to tail
     copy(cipherText[len(cipherText) - 32: len(cipherText)], 
       res[i * 16 - 16 : i * 16 + 16])
+    // the blocks in front of the pair make no difference to its padding, so
+    // they can be left out if the oracle does not insist on them
+    query := cipherText
+    if shortQueries {
+      query = cipherText[len(cipherText) - 32:]
+    }
     // Guess the last block using padding oracle attack
-    lastBlock := guessLastBlock(cipherText)
+    lastBlock := guessLastBlock(query)
     // copy guessed last block into result buffer
     copy(res[i * 16 : i * 16 + 16], lastBlock)
     
@@ -117,6 +326,30 @@ error code/message feedback from `decrypt-test` program.
 Refer to README for detailed explanation.
 */
 func guessLastBlock(query []byte) []byte {
+  // Buffer actual C1
+  C1 := make([]byte, 16)
+  copy(C1, query[len(query) - 32 : len(query) - 16])
+  I2, ok := recoverIntermediate(query, 16)
+  if !ok {
+    fmt.Println()
+    fmt.Println("Attack failed: no byte value produced a valid padding")
+    printResponses()
+    os.Exit(1)
+  }
+  // get P2 from I2 and C1
+  for i := range I2 {
+    I2[i] ^= C1[i]
+  }
+  return I2
+}
+
+/*
+Recover the last `count` bytes of the intermediate state I2 of the last block
+of `query`, which is clobbered in the process. Returns false if at some byte no
+value produced a valid padding, i.e. the oracle does not validate the padding
+the way `paddingScheme` and `paddingCheck` say.
+*/
+func recoverIntermediate(query []byte, count int) ([]byte, bool) {
   /*
   we are trying to crack the I2 = aes-dec(C2), where C2 is the last block of 
   the ciphertext. Note that I2 is then xor-ed with C1, which is the second to
@@ -127,12 +360,9 @@ func guessLastBlock(query []byte) []byte {
   The move here is to use a fake C1, which is named C_1 here, to try for each
   byte of I2.
   Once we have I2 by iterative trying, we can just get P2 = I2 xor C1, which
-  is buffered at beginning.
+  is buffered by the caller.
   */
 
-  // Buffer actual C1
-  C1 := make([]byte, 16)
-  copy(C1, query[len(query) - 32 : len(query) - 16])
   // Result buffer for I2
   I2 := make([]byte, 16)
   // make sure C_1 points to the second to last block of the ciphertext, which
@@ -141,43 +371,460 @@ func guessLastBlock(query []byte) []byte {
   C_1 := query[len(query) - 32 : len(query) - 16]
   _, err := rand.Read(C_1)
   check(err)
+  // whether the other reading of the last byte has been tried, see below
+  retried := false
   // try for each byte of the last block, or I2
-  for i := 15; i >= 0; i-- {
-    padLen := byte(16 - i)
+  for i := 15; i >= 16 - count; i-- {
+    // the padding we want the plaintext to end in, bytes i to 15
+    target := targetPadding(i)
     for j := i + 1; j < 16; j++ {
-      C_1[j] = padLen ^ I2[j]
+      C_1[j] = target[j] ^ I2[j]
     }
 
-    for k := 0x00; k < 0x100;  {
+    k := 0x00
+    for ; k < 0x100;  {
       // iterate all possible values for this byte of C_1 until it produces 
       // valid padding after xor-ed with I2
       C_1[i] = byte(k)
-    
-      var outputToFile []byte
-      // hexadecimal output
-      outputToFile = make([]byte, hex.EncodedLen(len(query)))
-      hex.Encode(outputToFile, query)
-      ioutil.WriteFile("test.txt", outputToFile, 0644)      
-      
-      // delegate to `decrypt-test` program, and get its response message
-      out, err := exec.Command("./decrypt-test", "-i", "test.txt").CombinedOutput()
-      check(err)
 
-      if !strings.Contains(string(out), "INVALID PADDING") {       
+      if !strings.Contains(queryOracle(query), "INVALID PADDING") {       
+        // For the very last byte, a longer padding may have happened to be
+        // valid instead (e.g. 0x02 0x02 for PKCS #7). Changing every byte in
+        // front of it breaks such a padding, whichever of its bytes the
+        // oracle looks at (first-last only compares the first one), but not
+        // the one we are after
+        if i == 15 {
+          for j := 0; j < 15; j++ {
+            C_1[j] ^= 1
+          }
+          stillValid := !strings.Contains(queryOracle(query), "INVALID PADDING")
+          for j := 0; j < 15; j++ {
+            C_1[j] ^= 1
+          }
+          if !stillValid {
+            k++
+            continue
+          }
+        }
         // We have a valid padding, I2[i] found
         break;
       }
       k++
     }
+    if k == 0x100 {
+      // An oracle that accepts a padding length of 0 took the last byte as
+      // 0x00 just as well as 0x01, and we assumed 0x01. If that was wrong, the
+      // last byte is now 0x03 instead of 0x02 and nothing fits in front of
+      // it: switch to the other reading and try this byte again
+      if i == 14 && paddingCheck == "allow-zero" && !retried {
+        retried = true
+        I2[15] ^= 1
+        i++
+        continue
+      }
+      return I2, false
+    }
     // restore I2[i]
-    I2[i] = padLen ^ C_1[i]
+    I2[i] = target[i] ^ C_1[i]
 
   }
-  // get P2 from I2 and C1
-  for i := range I2 {
-    I2[i] ^= C1[i]
+  return I2, true
+}
+
+/*
+The plaintext the attack aims for while recovering byte `i` of the last block:
+the shortest padding of `paddingScheme` that reaches back to byte `i`. Only
+bytes i to 15 of the returned block matter.
+  pkcs7  : 16 - i bytes of value 16 - i
+  x923   : zeros, then 16 - i as the last byte
+  iso7816: 0x80 at byte i, then zeros
+*/
+func targetPadding(i int) []byte {
+  target := make([]byte, 16)
+  padLen := byte(16 - i)
+  switch paddingScheme {
+  case "x923":
+    target[15] = padLen
+  case "iso7816":
+    target[i] = 0x80
+  default:
+    for j := i; j < 16; j++ {
+      target[j] = padLen
+    }
   }
-  return I2
+  return target
+}
+
+/*
+Length of the padding of `paddingScheme` at the end of the recovered `text`,
+or 0 if it is not a valid padding.
+*/
+func paddingLength(text []byte) int {
+  n := len(text)
+  if paddingScheme == "iso7816" {
+    for i := 1; i <= 16 && i <= n; i++ {
+      if text[n - i] == 0x80 {
+        return i
+      }
+      if text[n - i] != 0 {
+        break
+      }
+    }
+    return 0
+  }
+  padLen := int(text[n - 1])
+  if padLen > 16 || padLen > n {
+    return 0
+  }
+  for i := 2; i <= padLen; i++ {
+    if paddingScheme == "pkcs7" && int(text[n - i]) != padLen || paddingScheme == "x923" && text[n - i] != 0 {
+      return 0
+    }
+  }
+  return padLen
+}
+
+/*
+Probe whether the oracle reports padding errors. The last byte of the second
+to last block is run through all 256 values: with CBC this walks the last
+plaintext byte through all values as well, and nearly all of them are invalid
+padding. A padding-free mode such as CBC-CS3, encrypt-then-MAC or AES-GCM
+never answers with a padding error, whatever the byte is.
+*/
+func paddingSensitive(cipherTextWithIV []byte) bool {
+  query := make([]byte, len(cipherTextWithIV))
+  copy(query, cipherTextWithIV)
+  pos := len(query) - 17
+  for k := 0x00; k < 0x100; k++ {
+    query[pos] = cipherTextWithIV[pos] ^ byte(k)
+    if strings.Contains(queryOracle(query), "INVALID PADDING") {
+      return true
+    }
+  }
+  return false
+}
+
+/*
+Fingerprint the oracle behind `cipherTextWithIV` of the scheme `scheme`
+without attacking it. Prints a short report on
+  - whether padding errors can be told apart from the other responses,
+  - the block size, found by cutting bytes off the end until the response
+    changes, which relies on the oracle rejecting ragged lengths,
+  - the padding scheme it validates, by recovering the last three bytes under
+    each hypothesis: the wrong one runs into a byte that no value fixes,
+  - whether it takes a query of just the last two blocks,
+  - and the average response time.
+If the oracle can be attacked, the matching flags are written to `configFile`
+for a later run with -config.
+*/
+func probe(cipherTextWithIV []byte, scheme, oracleArgsStr, configFile string) {
+  n := len(cipherTextWithIV)
+  query := make([]byte, n)
+
+  // walk the last plaintext byte through all 256 values, with random bytes in
+  // front of it so that only a padding of length 1 fits, unless nothing but
+  // the last byte is checked
+  valid := 0
+  copy(query, cipherTextWithIV)
+  _, err := rand.Read(query[n - 32 : n - 17])
+  check(err)
+  for k := 0x00; k < 0x100; k++ {
+    query[n - 17] = byte(k)
+    if !strings.Contains(queryOracle(query), "INVALID PADDING") {
+      valid++
+    }
+  }
+  sensitive := valid < 0x100
+  if sensitive {
+    fmt.Printf("%-20s yes, %d of 256 last bytes rejected\n", "padding errors:", 0x100 - valid)
+  } else {
+    fmt.Printf("%-20s no\n", "padding errors:")
+  }
+
+  blockSize := 0
+  first := queryOracle(cipherTextWithIV[:n - 1])
+  for b := 2; b <= 32 && b < n; b++ {
+    if queryOracle(cipherTextWithIV[:n - b]) != first {
+      blockSize = b
+      break
+    }
+  }
+  if blockSize == 0 {
+    fmt.Printf("%-20s unknown, the oracle does not reject ragged lengths\n", "block size:")
+  } else {
+    fmt.Printf("%-20s %d\n", "block size:", blockSize)
+  }
+
+  // every last byte from 0x01 to 0x10 is accepted when nothing in front of it
+  // is checked
+  lastByteOnly := valid >= 16 && sensitive
+  found := false
+  if lastByteOnly {
+    fmt.Printf("%-20s only the last byte is checked (iso10126, or pkcs7 with -check last-byte)\n", "padding scheme:")
+  } else if sensitive {
+    candidates := [][2]string{{"pkcs7", "strict"}, {"pkcs7", "allow-zero"}, {"x923", "strict"}, {"iso7816", "strict"}}
+    for _, candidate := range candidates {
+      paddingScheme, paddingCheck = candidate[0], candidate[1]
+      copy(query, cipherTextWithIV)
+      I2, ok := recoverIntermediate(query, 3)
+      if !ok {
+        continue
+      }
+      found = true
+      // a strict pkcs7 validator may have been lucky; a last byte of 0x00
+      // tells the two apart
+      if paddingScheme == "pkcs7" && paddingCheck == "strict" {
+        copy(query, cipherTextWithIV)
+        query[n - 17] = I2[15]
+        if !strings.Contains(queryOracle(query), "INVALID PADDING") {
+          paddingCheck = "allow-zero"
+        }
+      }
+      break
+    }
+    if found {
+      fmt.Printf("%-20s %s, check %s\n", "padding scheme:", paddingScheme, paddingCheck)
+    } else {
+      fmt.Printf("%-20s unknown, none of pkcs7, x923 or iso7816 fits\n", "padding scheme:")
+    }
+  } else {
+    fmt.Printf("%-20s none visible\n", "padding scheme:")
+  }
+
+  twoBlock := found && acceptsTwoBlocks(cipherTextWithIV)
+  if !found {
+    fmt.Printf("%-20s not tested\n", "two-block queries:")
+  } else if twoBlock {
+    fmt.Printf("%-20s accepted\n", "two-block queries:")
+  } else {
+    fmt.Printf("%-20s rejected, full-length queries needed\n", "two-block queries:")
+  }
+
+  queries := queryCount()
+  latency := queryTime / time.Duration(queries)
+  fmt.Printf("%-20s %v over %d queries\n", "average latency:", latency, queries)
+
+  if !found {
+    fmt.Println("the oracle cannot be attacked, no configuration written")
+    os.Exit(1)
+  }
+  queryType := "full"
+  if twoBlock {
+    queryType = "short"
+  }
+  config := fmt.Sprintf("# suggested by decrypt-attack -probe\n" +
+    "oracle = %s\noracle-args = %s\nscheme = %s\npadding = %s\ncheck = %s\nquery = %s\n" +
+    "# block size: %d, average latency: %v\n",
+    oracleCmd, oracleArgsStr, scheme, paddingScheme, paddingCheck, queryType, blockSize, latency)
+  err = ioutil.WriteFile(configFile, []byte(config), 0644)
+  check(err)
+  fmt.Println("suggested configuration written to", configFile)
+}
+
+/*
+Whether the oracle takes a query of only the last two blocks of
+`cipherTextWithIV`. On their own they still end in the original padding, and
+pushing its last byte past 16 (or off 0x80 and 0x00) has to break it. An oracle
+that insists on the full ciphertext answers both the same way.
+*/
+func acceptsTwoBlocks(cipherTextWithIV []byte) bool {
+  n := len(cipherTextWithIV)
+  if n == 32 {
+    return true
+  }
+  pair := make([]byte, 32)
+  copy(pair, cipherTextWithIV[n - 32:])
+  intact := queryOracle(pair)
+  pair[15] ^= 0x20
+  broken := queryOracle(pair)
+  return !strings.Contains(intact, "INVALID PADDING") && strings.Contains(broken, "INVALID PADDING")
+}
+
+// average time the oracle takes to answer `query`, over `count` tries
+func averageLatency(query []byte, count int) time.Duration {
+  before := queryTime
+  for i := 0; i < count; i++ {
+    queryOracle(query)
+  }
+  return (queryTime - before) / time.Duration(count)
+}
+
+// number of queries made so far
+func queryCount() int {
+  queries := 0
+  for _, count := range responses {
+    queries += count
+  }
+  return queries
+}
+
+/*
+Set the flags listed in the configuration file `file`, one "name = value" per
+line, with # starting a comment line. Flags that were given on the command line
+are left alone.
+*/
+func loadConfig(file string) {
+  data, err := ioutil.ReadFile(file)
+  if err != nil {
+    fmt.Printf ("config file %s does not exit!\n", file)
+    os.Exit(1)
+  }
+  explicit := make(map[string]bool)
+  flag.Visit(func(f *flag.Flag) {
+    explicit[f.Name] = true
+  })
+  for _, line := range strings.Split(string(data), "\n") {
+    line = strings.TrimSpace(line)
+    if line == "" || strings.HasPrefix(line, "#") {
+      continue
+    }
+    eq := strings.Index(line, "=")
+    if eq < 0 {
+      fmt.Printf("config file %s: no \"=\" in line %q\n", file, line)
+      os.Exit(1)
+    }
+    name, value := strings.TrimSpace(line[:eq]), strings.TrimSpace(line[eq + 1:])
+    if explicit[name] {
+      continue
+    }
+    if err := flag.Set(name, value); err != nil {
+      fmt.Printf("config file %s: %v\n", file, err)
+      os.Exit(1)
+    }
+  }
+}
+
+/*
+Submit `query` to the oracle and return its response message. The query is
+written hex formatted into test.txt, which is handed to the oracle program.
+*/
+func queryOracle(query []byte) string {
+  var outputToFile []byte
+  query = append(query[:len(query):len(query)], querySuffix...)
+  // hexadecimal output
+  outputToFile = make([]byte, hex.EncodedLen(len(query)))
+  hex.Encode(outputToFile, query)
+  queryBytes += len(outputToFile)
+  ioutil.WriteFile("test.txt", outputToFile, 0644)      
+
+  // delegate to the oracle program, and get its response message
+  args := append([]string{"-i", "test.txt"}, oracleArgs...)
+  start := time.Now()
+  out, err := exec.Command(oracleCmd, args...).CombinedOutput()
+  queryTime += time.Since(start)
+  check(err)
+  responses[string(out)]++
+  return string(out)
+}
+
+// print how often the oracle gave each response
+func printResponses() {
+  fmt.Println("oracle responses:")
+  for response, count := range responses {
+    fmt.Printf("  %-24s %d\n", response, count)
+  }
+}
+
+/*
+Check the "Container:" line a versioned container starts with, if `headers`
+has one: the magic has to be right and the version one this program reads.
+Files without it are read the way they always were.
+*/
+func checkContainer(headers map[string]string) {
+  container, ok := headers["Container"]
+  if !ok {
+    return
+  }
+  fields := strings.Fields(container)
+  if len(fields) != 2 || fields[0] != containerMagic {
+    fmt.Println("Input file is not an encrypt-auth container.")
+    os.Exit(1)
+  }
+  if fields[1] != strconv.Itoa(containerVersion) {
+    fmt.Printf("Input file is a version %s container, this program reads version %d.\n", fields[1], containerVersion)
+    os.Exit(1)
+  }
+}
+
+/*
+CRC-24 of OpenPGP (RFC 4880, section 6.1), the checksum at the foot of an
+armored file.
+*/
+func crc24(data []byte) uint32 {
+  crc := uint32(0xb704ce)
+  for _, b := range data {
+    crc ^= uint32(b) << 16
+    for i := 0; i < 8; i++ {
+      crc <<= 1
+      if crc & 0x1000000 != 0 {
+        crc ^= 0x1864cfb
+      }
+    }
+  }
+  return crc & 0xffffff
+}
+
+/*
+Turn an armored file back into header lines followed by hex, the form the rest
+of the program reads. Anything else is returned as it is. Exits when the armor
+is broken or the checksum does not match, which is what a line lost or mangled
+in pasting looks like.
+*/
+func dearmor(data []byte) []byte {
+  text := strings.TrimSpace(strings.Replace(string(data), "\r\n", "\n", -1))
+  if !strings.HasPrefix(text, armorBegin + "\n") {
+    return data
+  }
+  lines := strings.Split(text, "\n")
+  if lines[len(lines) - 1] != armorEnd {
+    fmt.Println("Input file is armored but has no END line.")
+    os.Exit(1)
+  }
+  lines = lines[1 : len(lines) - 1]
+  // the headers run up to the first blank line
+  var res []byte
+  i := 0
+  for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+    res = append(res, lines[i] + "\n"...)
+  }
+  var body, checksum string
+  for _, line := range lines[i:] {
+    line = strings.TrimSpace(line)
+    if strings.HasPrefix(line, "=") {
+      checksum = line[1:]
+    } else {
+      body += line
+    }
+  }
+  raw, err := base64.StdEncoding.DecodeString(body)
+  sum, errSum := base64.StdEncoding.DecodeString(checksum)
+  if err != nil || errSum != nil || len(sum) != 3 || crc24(raw) != uint32(sum[0]) << 16 | uint32(sum[1]) << 8 | uint32(sum[2]) {
+    fmt.Println("Input file is armored, but its body does not match the checksum.")
+    os.Exit(1)
+  }
+  return append(res, hex.EncodeToString(raw)...)
+}
+
+/*
+Split the "Name: value" header lines that encrypt-auth writes off the front of
+a file. Returns the headers found and the rest of the file.
+*/
+func parseHeaders(data []byte) (map[string]string, []byte) {
+  headers := make(map[string]string)
+  for {
+    end := bytes.IndexByte(data, '\n')
+    if end < 0 {
+      break
+    }
+    line := string(data[:end])
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+      break
+    }
+    headers[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon + 1:])
+    data = data[end + 1:]
+  }
+  return headers, data
 }
 
 /*
@@ -10,11 +10,18 @@ import (
   "fmt"
   "os"
   "encoding/hex"
+  "encoding/base64"
   "crypto/sha256"
+  "encoding/binary"
+  "math/bits"
   "crypto/aes"
+  "crypto/cipher"
   "reflect"
   "strconv"
   "strings"
+  "flag"
+  "bytes"
+  "time"
 )
 
 const keyStr string = 
@@ -28,6 +35,34 @@ func check(e error) {
   }
 }
 
+// which PKCS #7 validator stripPadding uses, see `stripPadding`
+var paddingCheck string
+// whether the encryption key doubles as the IV, see `splitIV`
+var keyAsIV bool
+// time added for every SHA-256 compression of the tls scheme's HMAC, see
+// `tlsMAC`
+var blockDelay time.Duration
+// how tags are compared, and the time taken per byte compared, see
+// `tagsEqual`
+var tagCompare string
+var byteDelay time.Duration
+// how tags are computed: hmac, or naive for SHA256(key || message), see
+// `computeTag`
+var macAlgo string
+// which SHA-256 the hashing uses, see `sha256Sum`
+var sha256Impl string
+// the magic and version that start a container, see `checkContainer`. Version
+// 2 tags mte messages over the associated data length even when there is no
+// associated data, which version 1 left out, see `macInput`
+const containerMagic string = "encrypt-auth"
+const containerVersion int = 2
+// the lines an armored file starts and ends with, see `dearmor`
+const armorBegin string = "-----BEGIN ENCRYPT-AUTH MESSAGE-----"
+const armorEnd string = "-----END ENCRYPT-AUTH MESSAGE-----"
+// the keys the oracle decrypts and checks tags with, the test key unless
+// given on the command line, see `splitKey`
+var encKey, macKey []byte
+
 type MyError string
 
 func (e MyError) Error() string {
@@ -35,32 +70,532 @@ func (e MyError) Error() string {
 }
 
 func main() {
-  args := os.Args[1:]
+  inputFileNameFlag := flag.String("i", "", "input file name")
+  hardenedFlag := flag.Bool("hardened", false, `a bool, defaults to false, use the hardened decryption that reports one uniform error`)
+  schemeFlag := flag.String("scheme", "", `how encryption and MAC are composed: mte, etm, eam, gcm, tls or none. Defaults to the scheme recorded in the input file, or mte`)
+  aadFlag := flag.String("aad", "", "associated data in hex representation. gcm and mte schemes only")
+  modeFlag := flag.String("mode", "", `block cipher mode of operation: cbc or cs3 (CBC with ciphertext stealing). Defaults to the mode recorded in the input file, or cbc`)
+  paddingFlag := flag.String("padding", "", `padding scheme, cbc mode only: pkcs7, x923, iso7816, iso10126 or zero. Defaults to the padding recorded in the input file, or pkcs7`)
+  ivKeyFlag := flag.Bool("iv-key", false, "the encryption key is the IV, and the input holds no IV. Defaults to what the input file records")
+  leakFlag := flag.Bool("leak", false, "report the decrypted plaintext along with any error, like a careless server echoing what it could not parse")
+  checkFlag := flag.String("check", "strict", `how pkcs7 padding is validated: strict, or one of the buggy validators allow-zero, no-upper-bound, first-last or last-byte`)
+  blockDelayFlag := flag.Duration("block-delay", 0, "time the tls scheme spends on every SHA-256 compression of its HMAC, e.g. 1ms, to make the timing visible across process runs")
+  compareFlag := flag.String("compare", "equal", `how tags are compared in the mte, etm and eam schemes: equal (reflect.DeepEqual), early-exit (byte by byte, stopping at the first difference) or constant-time`)
+  byteDelayFlag := flag.Duration("byte-delay", 0, "time the tag comparison spends on every byte it looks at, e.g. 1ms, to make the timing visible across process runs")
+  macFlag := flag.String("mac", "", `how tags are computed in the mte, etm and eam schemes: hmac or naive (SHA256(key || message)). Defaults to the MAC recorded in the input file, or hmac`)
+  sha256Flag := flag.String("sha256", "std", "SHA-256 implementation used by the MAC: std (crypto/sha256) or scratch (written out in this program)")
+  keyFlag := flag.String("k", "", "32, 48 or 64-byte-long key in hex representation: the first half is Enc_key, for AES-128, -192 or -256, the second Mac_key. Defaults to the test key")
+  encKeyFlag := flag.String("enc-key", "", "Enc_key on its own in hex representation, 16, 24 or 32 bytes long, instead of -k. Needs -mac-key as well")
+  macKeyFlag := flag.String("mac-key", "", "Mac_key on its own in hex representation, of any length, instead of -k. Needs -enc-key as well")
+  flag.Parse()
+  aad, err := hex.DecodeString(*aadFlag)
+  if *keyFlag == "" && *encKeyFlag == "" && *macKeyFlag == "" {
+    *keyFlag = keyStr
+  }
+  var ok bool
+  encKey, macKey, ok = splitKey(*keyFlag, *encKeyFlag, *macKeyFlag)
   // validate command line arguments
-  if len(args) != 2 || args[0] != "-i" {
-    fmt.Println(
-      `usage: ./decrypt-test -i <input file name>`)
+  if *inputFileNameFlag == "" || flag.NArg() != 0 || err != nil || !ok {
+    usage()
+  }
+  paddingCheck = *checkFlag
+  blockDelay = *blockDelayFlag
+  tagCompare = *compareFlag
+  byteDelay = *byteDelayFlag
+  headers, cipherTextWithIV := readCipherText(*inputFileNameFlag)
+  checkContainer(headers)
+  scheme := *schemeFlag
+  if scheme == "" {
+    scheme = headers["Scheme"]
+  }
+  if scheme == "" {
+    scheme = "mte"
+  }
+  mode := *modeFlag
+  if mode == "" {
+    mode = headers["Mode"]
+  }
+  if mode == "" {
+    mode = "cbc"
+  }
+  padding := *paddingFlag
+  if padding == "" {
+    padding = headers["Padding"]
+  }
+  if padding == "" {
+    padding = "pkcs7"
+  }
+  keyAsIV = *ivKeyFlag || headers["IV"] == "key"
+  sha256Impl = *sha256Flag
+  macAlgo = *macFlag
+  if macAlgo == "" {
+    macAlgo = headers["MAC"]
+  }
+  if macAlgo == "" {
+    macAlgo = "hmac"
+  }
+  validPadding := padding == "pkcs7" || padding == "x923" || padding == "iso7816" || padding == "iso10126" || padding == "zero"
+  validMAC := (macAlgo == "hmac" || macAlgo == "naive") && (sha256Impl == "std" || sha256Impl == "scratch")
+  validCompare := tagCompare == "equal" || tagCompare == "early-exit" || tagCompare == "constant-time"
+  validCheck := paddingCheck == "strict" || paddingCheck == "allow-zero" || paddingCheck == "no-upper-bound" || paddingCheck == "first-last" || paddingCheck == "last-byte"
+  if !(scheme == "mte" || scheme == "etm" || scheme == "eam" || scheme == "gcm" || scheme == "tls" || scheme == "none") || !(mode == "cbc" || mode == "cs3") || !validPadding || !validCheck || !validCompare || !validMAC ||
+    ((tagCompare != "equal" || macAlgo != "hmac") && (*hardenedFlag || scheme == "gcm" || scheme == "tls" || scheme == "none")) ||
+    (*hardenedFlag && (scheme != "mte" || mode != "cbc" || padding != "pkcs7" || paddingCheck != "strict" || keyAsIV)) ||
+    (keyAsIV && (scheme == "gcm" || scheme == "tls" || mode != "cbc")) || (scheme == "tls" && (mode != "cbc" || padding != "pkcs7")) || (len(aad) != 0 && scheme != "gcm" && scheme != "mte") ||
+    (mode != "cbc" && scheme == "gcm") || (padding != "pkcs7" && (mode != "cbc" || scheme == "gcm")) || (paddingCheck != "strict" && padding != "pkcs7") {
+    usage()
+  }
+  // keys derived with HKDF or PBKDF2 would need the master key or password and
+  // the recorded salt; the oracle only holds split keys, and trying those
+  // would end in a padding or MAC error that says nothing about the cause
+  if headers["KDF"] != "" && headers["KDF"] != "split" {
+    fmt.Printf("Input file was encrypted with keys from KDF %s, this oracle only takes split keys (-k, or -enc-key and -mac-key).\n", headers["KDF"])
     os.Exit(1)
   }
-  _, err := decrypt(args)
+  // a container records the key length and tag length, which have to match
+  // the oracle's key and the scheme
+  if headers["Container"] != "" && (headers["Key-Length"] != strconv.Itoa(len(encKey)) || headers["Tag-Length"] != strconv.Itoa(tagLength(scheme))) {
+    fmt.Println("Input file records a key or tag length this oracle does not use.")
+    os.Exit(1)
+  }
+  var plainText []byte
+  if *hardenedFlag {
+    plainText, err = decryptHardened(cipherTextWithIV, aad)
+  } else if scheme == "gcm" {
+    plainText, err = decryptGCM(cipherTextWithIV, aad)
+  } else if scheme == "tls" {
+    plainText, err = decryptTLS(cipherTextWithIV)
+  } else if scheme == "mte" {
+    plainText, err = decrypt(cipherTextWithIV, aad, mode, padding)
+  } else if scheme == "none" {
+    plainText, err = decryptNone(cipherTextWithIV, mode, padding)
+  } else {
+    plainText, err = decryptComposed(cipherTextWithIV, scheme, mode, padding)
+  }
   if err == nil {
     fmt.Print("SUCCESS")
+  } else if *leakFlag && len(plainText) != 0 {
+    // whatever got decrypted before the error, padding and all
+    fmt.Print(err.Error() + " " + hex.EncodeToString(plainText))
   } else {
     fmt.Print(err.Error())
   }
 }
 
+func usage() {
+  fmt.Println(
+    `usage: ./decrypt-test -i <input file name> [-hardened] [-scheme mte|etm|eam|gcm|tls|none] [-mode cbc|cs3] [-padding pkcs7|x923|iso7816|iso10126|zero]
+                      [-check strict|allow-zero|no-upper-bound|first-last|last-byte] [-aad <associated data in hex>] [-iv-key] [-leak] [-block-delay <duration>]
+                      [-compare equal|early-exit|constant-time] [-byte-delay <duration>] [-mac hmac|naive]
+                      [-sha256 std|scratch] [-k <32, 48 or 64-byte-long key in hex> | -enc-key <16, 24 or 32-byte-long key in hex> -mac-key <key in hex>]
+    -hardened only applies to the mte scheme in cbc mode with strict pkcs7 padding, -aad only to the gcm and mte schemes,
+    -padding only to cbc mode, -check only to pkcs7 padding, -iv-key only to cbc mode outside the gcm and tls schemes,
+    the tls scheme only to cbc mode with its own padding, and -compare and -mac only to the mte, etm and eam schemes`)
+  os.Exit(1)
+}
+
+/*
+Enc_key and Mac_key, either from a combined key `key` of 32, 48 or 64 bytes,
+split in half for AES-128, -192 or -256, or given apart as `encKeyHex` and
+`macKeyHex`. Returns false unless exactly one of the two ways is used and the
+lengths fit.
+*/
+func splitKey(key, encKeyHex, macKeyHex string) ([]byte, []byte, bool) {
+  if key != "" {
+    combined, err := hex.DecodeString(key)
+    if err != nil || encKeyHex != "" || macKeyHex != "" || !(len(combined) == 32 || len(combined) == 48 || len(combined) == 64) {
+      return nil, nil, false
+    }
+    return combined[:len(combined) / 2], combined[len(combined) / 2:], true
+  }
+  encKey, err := hex.DecodeString(encKeyHex)
+  if err != nil || !(len(encKey) == 16 || len(encKey) == 24 || len(encKey) == 32) {
+    return nil, nil, false
+  }
+  macKey, err := hex.DecodeString(macKeyHex)
+  if err != nil || len(macKey) == 0 {
+    return nil, nil, false
+  }
+  return encKey, macKey, true
+}
+
+/*
+Check the "Container:" line a versioned container starts with, if `headers`
+has one: the magic has to be right and the version one this program reads.
+Files without it are read the way they always were.
+*/
+func checkContainer(headers map[string]string) {
+  container, ok := headers["Container"]
+  if !ok {
+    return
+  }
+  fields := strings.Fields(container)
+  if len(fields) != 2 || fields[0] != containerMagic {
+    fmt.Println("Input file is not an encrypt-auth container.")
+    os.Exit(1)
+  }
+  if fields[1] != strconv.Itoa(containerVersion) {
+    fmt.Printf("Input file is a version %s container, this program reads version %d.\n", fields[1], containerVersion)
+    os.Exit(1)
+  }
+}
+
+/*
+CRC-24 of OpenPGP (RFC 4880, section 6.1), the checksum at the foot of an
+armored file.
+*/
+func crc24(data []byte) uint32 {
+  crc := uint32(0xb704ce)
+  for _, b := range data {
+    crc ^= uint32(b) << 16
+    for i := 0; i < 8; i++ {
+      crc <<= 1
+      if crc & 0x1000000 != 0 {
+        crc ^= 0x1864cfb
+      }
+    }
+  }
+  return crc & 0xffffff
+}
+
+/*
+Turn an armored file back into header lines followed by hex, the form the rest
+of the program reads. Anything else is returned as it is. Exits when the armor
+is broken or the checksum does not match, which is what a line lost or mangled
+in pasting looks like.
+*/
+func dearmor(data []byte) []byte {
+  text := strings.TrimSpace(strings.Replace(string(data), "\r\n", "\n", -1))
+  if !strings.HasPrefix(text, armorBegin + "\n") {
+    return data
+  }
+  lines := strings.Split(text, "\n")
+  if lines[len(lines) - 1] != armorEnd {
+    fmt.Println("Input file is armored but has no END line.")
+    os.Exit(1)
+  }
+  lines = lines[1 : len(lines) - 1]
+  // the headers run up to the first blank line
+  var res []byte
+  i := 0
+  for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+    res = append(res, lines[i] + "\n"...)
+  }
+  var body, checksum string
+  for _, line := range lines[i:] {
+    line = strings.TrimSpace(line)
+    if strings.HasPrefix(line, "=") {
+      checksum = line[1:]
+    } else {
+      body += line
+    }
+  }
+  raw, err := base64.StdEncoding.DecodeString(body)
+  sum, errSum := base64.StdEncoding.DecodeString(checksum)
+  if err != nil || errSum != nil || len(sum) != 3 || crc24(raw) != uint32(sum[0]) << 16 | uint32(sum[1]) << 8 | uint32(sum[2]) {
+    fmt.Println("Input file is armored, but its body does not match the checksum.")
+    os.Exit(1)
+  }
+  return append(res, hex.EncodeToString(raw)...)
+}
+
+// the length of the tag `scheme` adds: HMAC-SHA256, the GCM tag, or none
+func tagLength(scheme string) int {
+  switch scheme {
+  case "gcm":
+    return 16
+  case "none":
+    return 0
+  }
+  return 32
+}
+
 /*
 Main function that deals with decryption process. Calls into numerous 
 subroutines.
-Takes as arguments all the command line arguments `args`. Return a byte slice
-that can be written into a file.
+Takes as arguments the decoded (IV||ciphertext), the associated data, the
+block cipher mode and the padding scheme. Return a byte slice that can be
+written into a file.
+*/
+
+func decrypt(cipherTextWithIV, aad []byte, mode, padding string) ([]byte, error) {
+  if len(cipherTextWithIV) < 16 {
+    return nil, MyError("INVALID LENGTH")
+  }
+  // parse C to get C' and IV
+  IV, cipherText := splitIV(cipherTextWithIV, encKey)
+  // do the AES decryption first, as in a reverse order from encryption, and
+  // remove the PS padding from M'' to get M'
+  dePaddedPlainText, err := decryptMode(mode, padding, cipherText, encKey, IV)
+  if err != nil {
+    return dePaddedPlainText, err
+  }
+  if len(dePaddedPlainText) < 32 {
+    return dePaddedPlainText, MyError("INVALID MAC")
+  }
+  // parse the resultant M' to get the delivered tag T, and the original message
+  plainText, tag := dePaddedPlainText[:len(dePaddedPlainText) - 32], 
+    dePaddedPlainText[len(dePaddedPlainText) - 32:]
+  // Use HMAC to calculate a new Tag on the message and the associated data
+  newTag := computeTag(macInput(aad, plainText), macKey)
+  // Compare with the delivered tag, report error if mismatch
+  if !tagsEqual(tag, newTag) {
+    return plainText, MyError("INVALID MAC")
+  }
+  // return the plaintext message if authentication checked out
+  return plainText, nil
+}
+
+/*
+Hardened counterpart of `decrypt`, showing how the oracle should have been
+written. Every failure is reported as the same error, the padding is checked
+without branching on its content, the HMAC is computed for every length the
+message could have and the right one is picked out afterwards (the Lucky13
+mitigation), and the tags are compared in constant time. Neither the error
+message nor the work done tells the attacker whether the padding was valid.
+*/
+func decryptHardened(cipherTextWithIV, aad []byte) ([]byte, error) {
+  // IV plus at least three blocks, since M' = M || T is already 32 bytes long.
+  // This only depends on the public length of the ciphertext
+  if len(cipherTextWithIV) < 64 || len(cipherTextWithIV) % 16 != 0 {
+    return nil, MyError("DECRYPTION FAILED")
+  }
+  IV, cipherText := cipherTextWithIV[:16], cipherTextWithIV[16:]
+  plainTextPadded := aes_cbc_dec(cipherText, encKey, IV)
+  n := len(plainTextPadded)
+  // padLen is 0 when the padding is invalid, so the steps below do the same
+  // work either way
+  padLen, good := checkPaddingConstantTime(plainTextPadded)
+  msgLen := n - 32 - padLen
+  // pick the tag out of every possible position instead of slicing at a
+  // secret offset
+  tag := make([]byte, 32)
+  for off := 0; off <= 16; off++ {
+    mask := byte(-ctEq(off, padLen))
+    for j := range tag {
+      tag[j] |= plainTextPadded[n - 32 - off + j] & mask
+    }
+  }
+  // hashing only the message would take fewer SHA-256 compressions with a
+  // long padding than with a bad one. Instead the HMAC is computed over each
+  // of the 17 lengths the message can have, 1 to 16 bytes of padding or none,
+  // and the one for `padLen` is kept, so the same work is done every time
+  newTag := make([]byte, 32)
+  for off := 0; off <= 16; off++ {
+    mask := byte(-ctEq(off, padLen))
+    candidate := hmac(macInput(aad, plainTextPadded[:n - 32 - off]), macKey)
+    for j := range newTag {
+      newTag[j] |= candidate[j] & mask
+    }
+  }
+  plainText := plainTextPadded[:msgLen]
+  if good & ctCompare(tag, newTag) != 1 {
+    return nil, MyError("DECRYPTION FAILED")
+  }
+  return plainText, nil
+}
+
+/*
+Decryption of a TLS record in CBC mode, the way TLS 1.2 implementations did
+it before Lucky Thirteen: M || T || padding, where the padding is 1 to 256
+bytes that all hold its length minus one, and T covers the sequence number
+and M. Every failure is the same "BAD RECORD MAC", and a bad padding is
+treated as no padding at all so that the MAC is still computed, as RFC 5246
+advises. But then the HMAC runs over a few more bytes than it would for a good
+padding, and with SHA-256 a few more bytes can mean one more compression.
+*/
+func decryptTLS(cipherTextWithIV []byte) ([]byte, error) {
+  // IV, then at least the tag and one byte of padding
+  if len(cipherTextWithIV) < 64 || len(cipherTextWithIV) % 16 != 0 {
+    return nil, MyError("BAD RECORD MAC")
+  }
+  IV, cipherText := cipherTextWithIV[:16], cipherTextWithIV[16:]
+  plainTextPadded := aes_cbc_dec(cipherText, encKey, IV)
+  n := len(plainTextPadded)
+  padLen := int(plainTextPadded[n - 1]) + 1
+  good := padLen + 32 <= n
+  for i := 1; good && i <= padLen; i++ {
+    good = plainTextPadded[n - i] == plainTextPadded[n - 1]
+  }
+  if !good {
+    padLen = 0
+  }
+  msgLen := n - 32 - padLen
+  plainText, tag := plainTextPadded[:msgLen], plainTextPadded[msgLen : msgLen + 32]
+  if ctCompare(tag, tlsMAC(plainText, macKey)) != 1 || !good {
+    return nil, MyError("BAD RECORD MAC")
+  }
+  return plainText, nil
+}
+
+/*
+HMAC over the 8-byte sequence number and `text`, as the tls scheme's tag. The
+sequence number is always 0, one file being one record. The SHA-256 work is
+slowed down by `blockDelay` per 64-byte compression: one for each of the ipad
+and opad blocks, one for the outer hash of the inner digest, and as many as the
+inner hash needs for the sequence number, the text and the SHA-256 padding of
+at least 9 bytes.
+*/
+func tlsMAC(text, macKey []byte) []byte {
+  tag := hmac(append(make([]byte, 8), text...), macKey)
+  compressions := 3 + (8 + len(text) + 9 + 63) / 64
+  time.Sleep(time.Duration(compressions) * blockDelay)
+  return tag
+}
+
+/*
+The tag on `text` with the MAC `macAlgo` selects: HMAC-SHA256, or the naive
+SHA256(key || text), whose tag is also the hash state after the key and text
+and so can be carried on past them.
+*/
+func computeTag(text, macKey []byte) []byte {
+  if macAlgo == "naive" {
+    return sha256Sum(append(append([]byte{}, macKey...), text...))
+  }
+  return hmac(text, macKey)
+}
+
+/*
+What the mte scheme's tag covers: the associated data `aad`, prefixed with its
+length as an 8-byte big-endian integer, then the message. The length fixes
+where the associated data ends, so no bytes can be moved across that boundary
+without changing the tag. The length is there even when `aad` is empty, as
+eight zero bytes, so that no associated data cannot be confused with associated
+data that happens to hold what the message starts with. Files tagged over the
+message alone, as they were before associated data came in, no longer verify.
+*/
+func macInput(aad, text []byte) []byte {
+  prefix := make([]byte, 8)
+  binary.BigEndian.PutUint64(prefix, uint64(len(aad)))
+  return append(append(prefix, aad...), text...)
+}
+
+/*
+Compare the received tag with the computed one, the way `tagCompare` says:
+  equal        : reflect.DeepEqual, as the oracle always did
+  early-exit   : byte by byte, returning at the first difference. How long it
+                 takes tells how many leading bytes of the tag were right
+  constant-time: every byte is looked at, whatever the first difference
+`byteDelay` is spent on every byte looked at, which for constant-time is all
+of them.
+*/
+func tagsEqual(tag, newTag []byte) bool {
+  switch tagCompare {
+  case "early-exit":
+    compared := 0
+    equal := len(tag) == len(newTag)
+    for i := 0; equal && i < len(tag); i++ {
+      compared++
+      equal = tag[i] == newTag[i]
+    }
+    time.Sleep(time.Duration(compared) * byteDelay)
+    return equal
+  case "constant-time":
+    time.Sleep(time.Duration(len(newTag)) * byteDelay)
+    return ctCompare(tag, newTag) == 1
+  }
+  return reflect.DeepEqual(tag, newTag)
+}
+
+/*
+Decryption for the encrypt-then-MAC (etm) and encrypt-and-MAC (eam) schemes,
+where the input is (IV||ciphertext||tag). With etm the tag covers IV||C' and
+is checked before anything is decrypted, so only "INVALID MAC" can come out of
+a tampered ciphertext. With eam the tag covers M, which means the padding has
+to be removed first and the oracle leaks just like the default scheme.
+*/
+func decryptComposed(cipherTextWithIV []byte, scheme, mode, padding string) ([]byte, error) {
+  if len(cipherTextWithIV) < 64 {
+    return nil, MyError("INVALID MAC")
+  }
+  n := len(cipherTextWithIV)
+  cipherTextWithIV, tag := cipherTextWithIV[:n - 32], cipherTextWithIV[n - 32:]
+  if scheme == "etm" && !tagsEqual(tag, computeTag(cipherTextWithIV, macKey)) {
+    return nil, MyError("INVALID MAC")
+  }
+  IV, cipherText := splitIV(cipherTextWithIV, encKey)
+  plainText, err := decryptMode(mode, padding, cipherText, encKey, IV)
+  if err != nil {
+    return plainText, err
+  }
+  if scheme == "eam" && !tagsEqual(tag, computeTag(plainText, macKey)) {
+    return plainText, MyError("INVALID MAC")
+  }
+  return plainText, nil
+}
+
+/*
+Decryption without any MAC, for the none scheme. All that can go wrong is the
+length and the padding, so a ciphertext edited by cbc-bitflip is accepted as
+long as the last block is left alone.
+*/
+func decryptNone(cipherTextWithIV []byte, mode, padding string) ([]byte, error) {
+  if len(cipherTextWithIV) < 16 {
+    return nil, MyError("INVALID LENGTH")
+  }
+  IV, cipherText := splitIV(cipherTextWithIV, encKey)
+  return decryptMode(mode, padding, cipherText, encKey, IV)
+}
+
+/*
+Split IV||C' into the IV and the ciphertext. When the key is the IV, all of the
+input is ciphertext and the IV is a copy of `encKey`, or its first 16 bytes
+for AES-192 and AES-256, which decryption will overwrite.
 */
+func splitIV(cipherTextWithIV, encKey []byte) ([]byte, []byte) {
+  if keyAsIV {
+    IV := make([]byte, 16)
+    copy(IV, encKey)
+    return IV, cipherTextWithIV
+  }
+  return cipherTextWithIV[:16], cipherTextWithIV[16:]
+}
 
-func decrypt(args []string) ([]byte, error) {
-  inputFile := args[1]
+/*
+Decryption for the AES-GCM scheme, where the input is nonce||ciphertext||tag
+and `aad` is the associated data. There is no padding to get wrong: whatever
+has been tampered with, the only possible failure is the tag not checking out.
+*/
+func decryptGCM(cipherText, aad []byte) ([]byte, error) {
+  block, err := aes.NewCipher(encKey)
+  check(err)
+  gcm, err := cipher.NewGCM(block)
+  check(err)
+  if len(cipherText) < gcm.NonceSize() + gcm.Overhead() {
+    return nil, MyError("AUTHENTICATION FAILED")
+  }
+  nonce, cipherText := cipherText[:gcm.NonceSize()], cipherText[gcm.NonceSize():]
+  plainText, err := gcm.Open(nil, nonce, cipherText, aad)
+  if err != nil {
+    return nil, MyError("AUTHENTICATION FAILED")
+  }
+  return plainText, nil
+}
+
+/*
+Read in the input file and decode it into (IV||ciphertext). "Name: value"
+header lines in front of the data, as written by encrypt-auth, are returned
+separately. Hex format is tried first, and decimal format is used as a
+fallback.
+*/
+func readCipherText(inputFile string) (map[string]string, []byte) {
   data, err := ioutil.ReadFile(inputFile)
   check(err)
+  data = dearmor(data)
+  headers := make(map[string]string)
+  for {
+    end := bytes.IndexByte(data, '\n')
+    if end < 0 {
+      break
+    }
+    line := string(data[:end])
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+      break
+    }
+    headers[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon + 1:])
+    data = data[end + 1:]
+  }
   // read in and decode the hex formatted text file
   cipherTextWithIV := make([]byte, hex.DecodedLen(len(data)))
   _, err = hex.Decode(cipherTextWithIV, data)
@@ -74,42 +609,18 @@ func decrypt(args []string) ([]byte, error) {
     cipherTextWithIV[i] = byte(val)
     }
   }
-  key := make([]byte, 32)
-  _, err = hex.Decode(key, []byte(keyStr))
-  // split key
-  encKey, macKey := key[:16], key[16:]
-  // parse C to get C' and IV
-  IV, cipherText := cipherTextWithIV[:16], cipherTextWithIV[16:]
-  // do the AES CBC decryption first, as in a reverse order from encryption
-  plainTextPadded := aes_cbc_dec(cipherText, encKey, IV)
-  // remove the PS padding from M'' to get M'
-  dePaddedPlainText, err := stripPadding(plainTextPadded)
-  if err != nil {
-    return plainTextPadded, err
-  }
-  // parse the resultant M' to get the delivered tag T, and the original message
-  plainText, tag := dePaddedPlainText[:len(dePaddedPlainText) - 32], 
-    dePaddedPlainText[len(dePaddedPlainText) - 32:]
-  // Use HMAC to calculate a new Tag on the message
-  newTag := hmac(plainText, macKey)
-  // Compare with the delivered tag, report error if mismatch
-  if !reflect.DeepEqual(tag, newTag) {
-    return plainText, MyError("INVALID MAC")
-  }
-  // return the plaintext message if authentication checked out
-  return plainText, nil
+  return headers, cipherTextWithIV
 }
 
 /*
 Function that does HMAC. Takes as arguments the input text, and the key used
-for this MAC. SHA256 is used as the helper hash function.
+for this MAC. SHA256 (see `sha256Sum`) is used as the helper hash function.
 */
 func hmac(text []byte, key []byte) []byte {
   B := 64
   // if key is too long, hash it first
   if len(key) > B {
-    keyHashed := sha256.Sum256(key)
-    key = keyHashed[0:]
+    key = sha256Sum(key)
   }
   // if key is too short, pad 0x00 to the end first to B-byte length
   if len(key) < B {
@@ -120,23 +631,140 @@ func hmac(text []byte, key []byte) []byte {
     }
     key = append(key, pad...)
   }
-  // tmp1, tmp2, hash1, hash2 are just intermediate values during calculation
+  // tmp1, tmp2 are just intermediate values during calculation
   tmp1 := make([]byte, B)
   // xor with ipad first
   for i := range tmp1 {
     tmp1[i] = key[i] ^ 0x36
   }
   // first level hash on the result
-  hash1 := sha256.Sum256(append(tmp1, text...))
-  tmp1 = hash1[0:]
+  tmp1 = sha256Sum(append(tmp1, text...))
   tmp2 := make([]byte, B)
   // do a second xor with opad
   for i := range tmp2 {
     tmp2[i] = key[i] ^ 0x5C
   }
   // hash again
-  hash2 := sha256.Sum256(append(tmp2, tmp1...))
-  return hash2[0:]
+  return sha256Sum(append(tmp2, tmp1...))
+}
+
+/*
+SHA-256 of `data`, with the implementation `sha256Impl` selects: std for Go's
+crypto/sha256, scratch for the hand-written `sha256Digest` below.
+*/
+func sha256Sum(data []byte) []byte {
+  if sha256Impl == "scratch" {
+    d := newSHA256()
+    d.write(data)
+    return d.sum()
+  }
+  sum := sha256.Sum256(data)
+  return sum[:]
+}
+
+/*
+SHA-256 written out by hand, following FIPS 180-4. The internal state is left
+in the open: `h` is the chaining value after the first `length` bytes written,
+less the ones in `buf`, which are waiting for a whole 64-byte block. Setting
+`h` and `length` to a hash and the length it covered carries that hash on.
+*/
+type sha256Digest struct {
+  h [8]uint32
+  buf []byte
+  length uint64
+}
+
+// initial chaining value: the first 32 bits of the fractional parts of the
+// square roots of the first 8 primes
+var sha256H0 = [8]uint32{
+  0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+// round constants: the first 32 bits of the fractional parts of the cube
+// roots of the first 64 primes
+var sha256K = [64]uint32{
+  0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+  0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+  0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+  0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+  0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+  0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+  0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+  0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+}
+
+func newSHA256() *sha256Digest {
+  return &sha256Digest{h: sha256H0}
+}
+
+// hash `data`, one 64-byte block at a time
+func (d *sha256Digest) write(data []byte) {
+  d.length += uint64(len(data))
+  d.buf = append(d.buf, data...)
+  for len(d.buf) >= 64 {
+    sha256Compress(&d.h, d.buf[:64])
+    d.buf = d.buf[64:]
+  }
+}
+
+/*
+The hash of everything written so far. The message is padded with 0x80, zeros
+up to 8 bytes short of a whole block, and the length in bits as a 64-bit
+big-endian integer. This works on a copy of the state, so more can be written
+afterwards.
+*/
+func (d *sha256Digest) sum() []byte {
+  h := d.h
+  rest := append(append([]byte{}, d.buf...), 0x80)
+  for len(rest) % 64 != 56 {
+    rest = append(rest, 0)
+  }
+  bitLen := make([]byte, 8)
+  binary.BigEndian.PutUint64(bitLen, d.length * 8)
+  rest = append(rest, bitLen...)
+  for i := 0; i < len(rest); i += 64 {
+    sha256Compress(&h, rest[i : i + 64])
+  }
+  res := make([]byte, 32)
+  for i := range h {
+    binary.BigEndian.PutUint32(res[4 * i:], h[i])
+  }
+  return res
+}
+
+/*
+The SHA-256 compression function (FIPS 180-4, section 6.2.2): mix one 64-byte
+block into the chaining value `h`.
+*/
+func sha256Compress(h *[8]uint32, block []byte) {
+  // message schedule
+  var w [64]uint32
+  for t := 0; t < 16; t++ {
+    w[t] = binary.BigEndian.Uint32(block[4 * t:])
+  }
+  for t := 16; t < 64; t++ {
+    s0 := bits.RotateLeft32(w[t - 15], -7) ^ bits.RotateLeft32(w[t - 15], -18) ^ (w[t - 15] >> 3)
+    s1 := bits.RotateLeft32(w[t - 2], -17) ^ bits.RotateLeft32(w[t - 2], -19) ^ (w[t - 2] >> 10)
+    w[t] = w[t - 16] + s0 + w[t - 7] + s1
+  }
+  a, b, c, d, e, f, g, hh := h[0], h[1], h[2], h[3], h[4], h[5], h[6], h[7]
+  for t := 0; t < 64; t++ {
+    S1 := bits.RotateLeft32(e, -6) ^ bits.RotateLeft32(e, -11) ^ bits.RotateLeft32(e, -25)
+    ch := (e & f) ^ (^e & g)
+    t1 := hh + S1 + ch + sha256K[t] + w[t]
+    S0 := bits.RotateLeft32(a, -2) ^ bits.RotateLeft32(a, -13) ^ bits.RotateLeft32(a, -22)
+    maj := (a & b) ^ (a & c) ^ (b & c)
+    t2 := S0 + maj
+    hh, g, f, e, d, c, b, a = g, f, e, d + t1, c, b, a, t1 + t2
+  }
+  h[0] += a
+  h[1] += b
+  h[2] += c
+  h[3] += d
+  h[4] += e
+  h[5] += f
+  h[6] += g
+  h[7] += hh
 }
 
 /*
@@ -159,16 +787,125 @@ func aes_cbc_dec(cipherText, encKey, IV []byte) []byte {
   return cipherText
 }
 
+/*
+Decrypt `cipherText` in the block cipher mode `mode` and, for CBC, strip the
+padding of the scheme `padding`. CBC-CS3 has no padding, so the only error it
+can return is a ciphertext shorter than one block.
+*/
+func decryptMode(mode, padding string, cipherText, encKey, IV []byte) ([]byte, error) {
+  if len(cipherText) < 16 || (mode == "cbc" && len(cipherText) % 16 != 0) {
+    return cipherText, MyError("INVALID LENGTH")
+  }
+  if mode == "cs3" {
+    return aes_cbc_cs3_dec(cipherText, encKey, IV), nil
+  }
+  plainTextPadded := aes_cbc_dec(cipherText, encKey, IV)
+  return unpad(plainTextPadded, padding)
+}
+
+/*
+Strip the padding of the scheme `scheme` (see encrypt-auth for the layouts).
+Each scheme can only be as strict as the bytes it fixes: x923 checks the zeros,
+iso7816 looks for the 0x80 marker behind the zeros, iso10126 can only check
+that the last byte is a sensible length, and zero padding can never be invalid.
+*/
+func unpad(text []byte, scheme string) ([]byte, error) {
+  n := len(text)
+  switch scheme {
+  case "pkcs7":
+    return stripPadding(text)
+  case "x923", "iso10126":
+    padLen := int(text[n - 1])
+    if padLen == 0 || padLen > 16 {
+      return text, MyError("INVALID PADDING")
+    }
+    for i := 2; scheme == "x923" && i <= padLen; i++ {
+      if text[n - i] != 0 {
+        return text, MyError("INVALID PADDING")
+      }
+    }
+    return text[:n - padLen], nil
+  case "iso7816":
+    for i := 1; i <= 16; i++ {
+      if text[n - i] == 0x80 {
+        return text[:n - i], nil
+      }
+      if text[n - i] != 0 {
+        break
+      }
+    }
+    return text, MyError("INVALID PADDING")
+  }
+  for n > 0 && len(text) - n < 15 && text[n - 1] == 0 {
+    n--
+  }
+  return text[:n], nil
+}
+
+/*
+Do CBC-CS3 decryption on `cipherText` with the key `encKey` and the `IV`.
+Decrypting the second to last (full) block gives the last plaintext bytes
+xor-ed with the stolen ciphertext block, whose missing tail shows up right
+where the zeros were. With that block restored, the rest is ordinary CBC.
+*/
+func aes_cbc_cs3_dec(cipherText, encKey, IV []byte) []byte {
+  n := len(cipherText)
+  if n == 16 {
+    return aes_cbc_dec(cipherText, encKey, IV)
+  }
+  d := n % 16
+  if d == 0 {
+    d = 16
+  }
+  cipher, err := aes.NewCipher(encKey)
+  check(err)
+  // the block that was swapped to the second to last position
+  z := make([]byte, 16)
+  cipher.Decrypt(z, cipherText[n - 16 - d : n - d])
+  stolen := cipherText[n - d:]
+  lastPlain := make([]byte, d)
+  for j := range lastPlain {
+    lastPlain[j] = z[j] ^ stolen[j]
+  }
+  // put the stolen block back together and decrypt everything in front of it
+  restored := make([]byte, n - d)
+  copy(restored, cipherText[:n - 16 - d])
+  copy(restored[n - 16 - d:], stolen)
+  copy(restored[n - 16:], z[d:])
+  res := aes_cbc_dec(restored, encKey, IV)
+  return append(res, lastPlain...)
+}
+
 /*
 Strips out PS padding. Easy logic: read the last byte to get the padding length,
 then go on forward to make sure that the length checks out.
+Besides the strict check, `paddingCheck` selects one of the mistakes found in
+real-world validators:
+  allow-zero    : a padding length of 0 is accepted and nothing is stripped
+  no-upper-bound: lengths above the block size are not rejected, as long as
+                  the text is long enough
+  first-last    : only the last byte and the first padding byte are compared,
+                  the bytes in between are never looked at
+  last-byte     : only the last byte is checked to be a sensible length
 */
 func stripPadding(text []byte) ([]byte, error) {
   n := len(text)
   padLen := text[n - 1]
-  if padLen > 16 || padLen == 0 {
+  if padLen == 0 && paddingCheck == "allow-zero" {
+    return text, nil
+  }
+  if (padLen > 16 && paddingCheck != "no-upper-bound") || padLen == 0 || int(padLen) > n {
     return text, MyError("INVALID PADDING")
   }
+  if paddingCheck == "last-byte" {
+    return text[:n - int(padLen)], nil
+  }
+  if paddingCheck == "first-last" {
+    if text[n - int(padLen)] != padLen {
+      return text, MyError("INVALID PADDING")
+    }
+    return text[:n - int(padLen)], nil
+  }
   for i := 2; i <= int(padLen); i++ {
     if text[n - i] != padLen {
       return text, MyError("INVALID PADDING")
@@ -176,3 +913,47 @@ func stripPadding(text []byte) ([]byte, error) {
   }
   return text[:n - int(padLen)], nil
 }
+
+/*
+Constant time version of `stripPadding`. Instead of returning early, all of the
+last 16 bytes are inspected and the result is accumulated with masks. Returns
+the padding length and 1 if the padding is valid, or 0 and 0 if it is not.
+*/
+func checkPaddingConstantTime(text []byte) (int, int) {
+  n := len(text)
+  padLen := int(text[n - 1])
+  good := ctLessOrEq(1, padLen) & ctLessOrEq(padLen, 16)
+  for i := 1; i <= 16; i++ {
+    // bytes in front of the padding are masked out rather than skipped
+    inPadding := ctLessOrEq(i, padLen)
+    good &= ctEq(int(text[n - i]), padLen) | (inPadding ^ 1)
+  }
+  return ctSelect(good, padLen, 0), good
+}
+
+// returns 1 if x == y and 0 otherwise, for small non-negative x and y
+func ctEq(x, y int) int {
+  return int((uint32(x ^ y) - 1) >> 31)
+}
+
+// returns 1 if x <= y and 0 otherwise, for small non-negative x and y
+func ctLessOrEq(x, y int) int {
+  return int((uint32(y - x) >> 31) ^ 1)
+}
+
+// returns x if v == 1 and y if v == 0
+func ctSelect(v, x, y int) int {
+  return (x & -v) | (y & (v - 1))
+}
+
+// returns 1 if a and b are equal, looking at every byte regardless
+func ctCompare(a, b []byte) int {
+  if len(a) != len(b) {
+    return 0
+  }
+  var v byte
+  for i := range a {
+    v |= a[i] ^ b[i]
+  }
+  return ctEq(int(v), 0)
+}
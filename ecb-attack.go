@@ -0,0 +1,156 @@
+package main
+
+import (
+  "io/ioutil"
+  "fmt"
+  "os"
+  "encoding/hex"
+  "os/exec"
+  "strings"
+  "flag"
+  "bytes"
+)
+
+/*
+Byte-at-a-time ECB decryption against `encrypt-oracle`, which encrypts
+attacker input || secret. Nothing is decrypted here: the oracle is only ever
+asked to encrypt, and the secret comes out one byte at a time by lining it up
+at the end of a block and matching that block against all 256 candidates.
+*/
+
+// command used to query the encryption oracle, and the extra flags passed to it
+var oracleCmd string
+var oracleArgs []string
+// number of queries made so far
+var queries int
+
+// routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  outputFileNameFlag := flag.String ("o", "restored-secret.txt", "output file name")
+  oracleFlag := flag.String ("oracle", "./encrypt-oracle", "encryption oracle program to query")
+  oracleArgsFlag := flag.String ("oracle-args", "", `extra flags passed to the oracle program, e.g. "-mode cbc"`)
+  flag.Parse()
+  oracleCmd = *oracleFlag
+  oracleArgs = strings.Fields(*oracleArgsFlag)
+
+  blockSize, secretLen := findBlockSize()
+  if blockSize == 0 {
+    fmt.Println("Attack failed: the ciphertext never grew, no block size found")
+    os.Exit(1)
+  }
+  fmt.Printf("block size: %d\n", blockSize)
+  if !isECB(blockSize) {
+    fmt.Println("oracle does not use ECB: equal plaintext blocks gave different ciphertext blocks")
+    os.Exit(1)
+  }
+  // with ECB there is no IV in front, so all of the ciphertext is input,
+  // secret and padding
+  fmt.Printf("mode: ecb, secret length: %d\n", secretLen)
+
+  secret := recoverSecret(blockSize, secretLen)
+  fmt.Printf("recovered %d bytes in %d queries\n", len(secret), queries)
+  outputContent := make([]byte, hex.EncodedLen(len(secret)))
+  hex.Encode(outputContent, secret)
+  ioutil.WriteFile(*outputFileNameFlag, outputContent, 0644)
+}
+
+/*
+Feed the oracle longer and longer inputs until the ciphertext grows. It grows
+by one block, and at that point input || secret just filled up the blocks
+before, so the secret is as long as the old ciphertext minus the input.
+Returns the block size and the secret length, or 0s if it never grew.
+*/
+func findBlockSize() (int, int) {
+  base := len(queryOracle(nil))
+  for i := 1; i <= 64; i++ {
+    size := len(queryOracle(bytes.Repeat([]byte{'A'}, i)))
+    if size > base {
+      return size - base, base - i
+    }
+  }
+  return 0, 0
+}
+
+/*
+Three blocks' worth of the same byte contain at least two whole equal blocks,
+which only ECB encrypts to equal ciphertext blocks.
+*/
+func isECB(blockSize int) bool {
+  cipherText := queryOracle(bytes.Repeat([]byte{'A'}, 3 * blockSize))
+  for i := blockSize; i + blockSize <= len(cipherText); i += blockSize {
+    if bytes.Equal(cipherText[i - blockSize : i], cipherText[i : i + blockSize]) {
+      return true
+    }
+  }
+  return false
+}
+
+/*
+Main function for the attack. To get byte i of the secret, pad the input so
+that the byte is the last one of a block, whose other bytes are then all
+known: filler or secret bytes already recovered. All 256 guesses of that block
+are sent in one query, and the one whose ciphertext matches is the byte.
+*/
+func recoverSecret(blockSize, secretLen int) []byte {
+  var secret []byte
+  // the oracle's answer to each length of filler, asked for only once
+  targets := make(map[int][]byte)
+  for i := 0; i < secretLen; i++ {
+    fillerLen := blockSize - 1 - i % blockSize
+    filler := bytes.Repeat([]byte{'A'}, fillerLen)
+    if targets[fillerLen] == nil {
+      targets[fillerLen] = queryOracle(filler)
+    }
+    block := i / blockSize
+    target := targets[fillerLen][block * blockSize : (block + 1) * blockSize]
+
+    // the block-size - 1 known bytes in front of byte i
+    known := append(filler, secret...)
+    known = known[len(known) - (blockSize - 1):]
+    guesses := make([]byte, 0, 256 * blockSize)
+    for b := 0; b < 256; b++ {
+      guesses = append(append(guesses, known...), byte(b))
+    }
+    cipherText := queryOracle(guesses)
+    b := 0
+    for ; b < 256; b++ {
+      if bytes.Equal(cipherText[b * blockSize : (b + 1) * blockSize], target) {
+        break
+      }
+    }
+    if b == 256 {
+      fmt.Println()
+      fmt.Println("Attack failed: no guess matched byte", i)
+      os.Exit(1)
+    }
+    secret = append(secret, byte(b))
+    fmt.Printf(".")
+  }
+  fmt.Println()
+  return secret
+}
+
+/*
+Submit `input` to the oracle and return the ciphertext. The input is written
+hex formatted into test.txt, which is handed to the oracle program, and the
+ciphertext comes back hex formatted on its output.
+*/
+func queryOracle(input []byte) []byte {
+  ioutil.WriteFile("test.txt", []byte(hex.EncodeToString(input)), 0644)
+  args := append([]string{"-i", "test.txt"}, oracleArgs...)
+  out, err := exec.Command(oracleCmd, args...).CombinedOutput()
+  check(err)
+  queries++
+  cipherText, err := hex.DecodeString(strings.TrimSpace(string(out)))
+  if err != nil {
+    fmt.Printf("oracle gave no ciphertext: %s\n", out)
+    os.Exit(1)
+  }
+  return cipherText
+}
@@ -8,12 +8,34 @@ import (
   "fmt"
   "os"
   "encoding/hex"
+  "encoding/base64"
   "crypto/sha256"
+  "encoding/binary"
+  "math/bits"
   "crypto/rand"
   "crypto/aes"
+  "crypto/cipher"
   "reflect"
+  "strconv"
+  "flag"
+  "bytes"
+  "strings"
 )
 
+// which SHA-256 the hashing uses, see `sha256Sum`
+var sha256Impl string
+// the magic and version that start a container, see `checkContainer`. Version
+// 2 tags mte messages over the associated data length even when there is no
+// associated data, which version 1 left out, see `macInput`
+const containerMagic string = "encrypt-auth"
+const containerVersion int = 2
+// the lines an armored file starts and ends with, see `armor`
+const armorBegin string = "-----BEGIN ENCRYPT-AUTH MESSAGE-----"
+const armorEnd string = "-----END ENCRYPT-AUTH MESSAGE-----"
+// which AES the modes use, see `newAES`, and whether it prints its rounds
+var aesImpl string
+var aesTrace bool
+
 //routine for error handling
 func check(e error) {
   if e != nil {
@@ -21,37 +43,425 @@ func check(e error) {
   }
 }
 
+// options for one run of the program, filled in from the command line
+type options struct {
+  // the key material from the command line, see `deriveKeys`: -k, -enc-key
+  // and -mac-key in hex, or -password
+  key, encKeyHex, macKeyHex, password string
+  // how Enc_key and Mac_key come from it: split, hkdf or pbkdf2
+  kdf string
+  // the salt and iteration count of the derivation, and the length of the
+  // Enc_key it gives
+  salt []byte
+  iterations int
+  keyLen int
+  inputFile string
+  // how encryption and MAC are composed: mte, etm, eam, gcm, tls, or none for
+  // no MAC at all
+  scheme string
+  // block cipher mode of operation: cbc, cs3, ctr, cfb, ofb or ecb
+  mode string
+  // padding scheme for cbc: pkcs7, x923, iso7816, iso10126 or zero
+  padding string
+  // associated data, authenticated but not encrypted
+  aad []byte
+  // whether the encryption key doubles as the cbc IV
+  ivKey bool
+  // how tags are computed: hmac, or naive for SHA256(Mac_key || message)
+  mac string
+  // the name of the key, recorded in containers and checked on decryption
+  keyID string
+}
+
 func main() {
   args := os.Args[1:]
-  // validate command line arguments
-  if len(args) != 7 || !(args[0] == "encrypt" || args[0] == "decrypt") || args[1] != "-k" || args[3] != "-i" || args[5] != "-o" || len(args[2]) != 64 {
-    fmt.Println(
-      `usage: ./encrypt-auth [mode] -k <32-byte-long key in hex representation> -i <input file name> -o <output file name>
-      [mode]: encrypt or decrypt
-      `)
-    os.Exit(1)
+  // validate command line arguments: the mode of operation comes first, and
+  // the flags follow it
+  if len(args) < 1 || !(args[0] == "encrypt" || args[0] == "decrypt") {
+    usage()
+  }
+  flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+  keyFlag := flags.String("k", "", "32, 48 or 64-byte-long key in hex representation: the first half is Enc_key, for AES-128, -192 or -256, the second Mac_key")
+  encKeyFlag := flags.String("enc-key", "", "Enc_key on its own in hex representation, 16, 24 or 32 bytes long, instead of -k. Needs -mac-key as well")
+  macKeyFlag := flags.String("mac-key", "", "Mac_key on its own in hex representation, of any length, instead of -k. Needs -enc-key as well")
+  passwordFlag := flags.String("password", "", "password to derive both keys from with PBKDF2, instead of -k")
+  kdfFlag := flags.String("kdf", "", `how Enc_key and Mac_key are made: split (-k cut in half, the default), hkdf (derived from -k as a master key of at least 16 bytes) or pbkdf2 (derived from -password, the default with -password). When decrypting, defaults to the KDF recorded in the input file`)
+  iterationsFlag := flags.Int("iterations", 100000, "PBKDF2 iteration count. When decrypting, the count recorded in the input file is used")
+  armorFlag := flags.Bool("armor", false, "write the ciphertext in ASCII armor, base64 between BEGIN and END lines with a checksum, instead of hex. Encryption only")
+  containerFlag := flags.Bool("container", false, "write a versioned container: a header that starts with a magic and version line and records every algorithm and parameter, defaults included")
+  keyIDFlag := flags.String("key-id", "", "name of the key, recorded in the container. When decrypting, the container has to record the same name")
+  keyLenFlag := flags.Int("key-len", 16, "length of the derived Enc_key, 16, 24 or 32 bytes for AES-128, -192 or -256. hkdf and pbkdf2 only. When decrypting, the length recorded in the input file is used")
+  inputFileFlag := flags.String("i", "", "input file name")
+  outputFileFlag := flags.String("o", "", "output file name")
+  schemeFlag := flags.String("scheme", "", `how encryption and MAC are composed: mte (MAC-then-encrypt, the default), etm (encrypt-then-MAC), eam (encrypt-and-MAC), gcm (AES-GCM), tls (MAC-then-encrypt laid out like a TLS record) or none (encryption only, no MAC). When decrypting, defaults to the scheme recorded in the input file`)
+  aadFlag := flags.String("aad", "", "associated data in hex representation, authenticated but not encrypted. gcm and mte schemes only. When decrypting, the same associated data has to be given again")
+  modeFlag := flags.String("mode", "", `block cipher mode of operation: cbc (the default), cs3 (CBC with ciphertext stealing), ctr, cfb, ofb or ecb. Not used by the gcm scheme. When decrypting, defaults to the mode recorded in the input file`)
+  ivKeyFlag := flags.Bool("iv-key", false, "use the encryption key as the IV and leave it out of the output, as some legacy systems do. cbc mode only, not for the gcm scheme. When decrypting, defaults to what the input file records")
+  paddingFlag := flags.String("padding", "", `padding scheme, cbc and ecb modes only: pkcs7 (the default), x923, iso7816, iso10126 or zero. When decrypting, defaults to the padding recorded in the input file`)
+  macFlag := flags.String("mac", "", `how the tag is computed in the mte, etm and eam schemes: hmac (the default) or naive (SHA256(Mac_key || message), open to length extension). When decrypting, defaults to the MAC recorded in the input file`)
+  sha256Flag := flags.String("sha256", "std", "SHA-256 implementation used by the MAC: std (crypto/sha256) or scratch (written out in this program)")
+  aesFlag := flags.String("aes", "std", "AES implementation used by every mode: std (crypto/aes) or scratch (written out in this program)")
+  aesTraceFlag := flags.Bool("aes-trace", false, "print the state after every step of every AES round, as in FIPS-197 Appendix C. scratch AES only")
+  flags.Parse(args[1:])
+  if flags.NArg() != 0 || *inputFileFlag == "" || *outputFileFlag == "" {
+    usage()
+  }
+  if !(*kdfFlag == "" || *kdfFlag == "split" || *kdfFlag == "hkdf" || *kdfFlag == "pbkdf2") || *iterationsFlag < 1 || !(*keyLenFlag == 16 || *keyLenFlag == 24 || *keyLenFlag == 32) {
+    usage()
+  }
+  if !(*schemeFlag == "" || *schemeFlag == "mte" || *schemeFlag == "etm" || *schemeFlag == "eam" || *schemeFlag == "gcm" || *schemeFlag == "tls" || *schemeFlag == "none") {
+    usage()
+  }
+  if !(*modeFlag == "" || *modeFlag == "cbc" || *modeFlag == "cs3" || *modeFlag == "ctr" || *modeFlag == "cfb" || *modeFlag == "ofb" || *modeFlag == "ecb") {
+    usage()
+  }
+  sha256Impl = *sha256Flag
+  if !(sha256Impl == "std" || sha256Impl == "scratch") {
+    usage()
+  }
+  aesImpl, aesTrace = *aesFlag, *aesTraceFlag
+  if !(aesImpl == "std" || aesImpl == "scratch") || aesTrace && aesImpl != "scratch" {
+    usage()
+  }
+  if !(*macFlag == "" || *macFlag == "hmac" || *macFlag == "naive") {
+    usage()
+  }
+  if !(*paddingFlag == "" || *paddingFlag == "pkcs7" || *paddingFlag == "x923" || *paddingFlag == "iso7816" || *paddingFlag == "iso10126" || *paddingFlag == "zero") {
+    usage()
+  }
+  aad, err := hex.DecodeString(*aadFlag)
+  if err != nil {
+    usage()
   }
+  opts := options{*keyFlag, *encKeyFlag, *macKeyFlag, *passwordFlag, *kdfFlag, nil, *iterationsFlag, *keyLenFlag,
+    *inputFileFlag, *schemeFlag, *modeFlag, *paddingFlag, aad, *ivKeyFlag, *macFlag, *keyIDFlag}
   var output []byte
+  var headers []string
   // choose proper mode: encryption or decryption
   if args[0] == "encrypt" {
-    output = encrypt(args)
+    if opts.scheme == "" {
+      opts.scheme = "mte"
+    }
+    if opts.mode == "" {
+      opts.mode = "cbc"
+    }
+    if opts.padding == "" {
+      opts.padding = "pkcs7"
+    }
+    if opts.mac == "" {
+      opts.mac = "hmac"
+    }
+    if opts.kdf == "" && opts.password != "" {
+      opts.kdf = "pbkdf2"
+    } else if opts.kdf == "" {
+      opts.kdf = "split"
+    }
+    if opts.mac != "hmac" && !(opts.scheme == "mte" || opts.scheme == "etm" || opts.scheme == "eam") || opts.kdf == "split" && opts.keyLen != 16 ||
+      opts.keyID != "" && !*containerFlag {
+      usage()
+    }
+    // the key length is known up front for the other KDFs
+    if opts.kdf == "split" {
+      encKey, _, ok := splitKey(opts.key, opts.encKeyHex, opts.macKeyHex)
+      if !ok {
+        usage()
+      }
+      opts.keyLen = len(encKey)
+    }
+    // a fresh salt for every file, so that the same master key or password
+    // gives different keys each time
+    if opts.kdf != "split" {
+      opts.salt = make([]byte, 16)
+      _, err = rand.Read(opts.salt)
+      check(err)
+    }
+    if len(opts.aad) != 0 && opts.scheme != "gcm" && opts.scheme != "mte" || opts.mode != "cbc" && opts.scheme == "gcm" || opts.padding != "pkcs7" && (opts.mode != "cbc" && opts.mode != "ecb" || opts.scheme == "gcm") ||
+      opts.ivKey && (opts.mode != "cbc" || opts.scheme == "gcm") || opts.scheme == "tls" && (opts.mode != "cbc" || opts.padding != "pkcs7") {
+      usage()
+    }
+    output = encrypt(opts)
+    if *containerFlag {
+      headers = containerHeaders(opts)
+    } else {
+      // the default scheme and mode keep the bare hex format, others are
+      // recorded so that decryption can pick them up
+      if opts.scheme != "mte" {
+        headers = append(headers, "Scheme: " + opts.scheme)
+      }
+      if opts.mode != "cbc" {
+        headers = append(headers, "Mode: " + opts.mode)
+      }
+      if opts.padding != "pkcs7" {
+        headers = append(headers, "Padding: " + opts.padding)
+      }
+      if opts.ivKey {
+        headers = append(headers, "IV: key")
+      }
+      if opts.mac != "hmac" {
+        headers = append(headers, "MAC: " + opts.mac)
+      }
+      if opts.kdf != "split" {
+        headers = append(headers, "KDF: " + opts.kdf, "Salt: " + hex.EncodeToString(opts.salt))
+      }
+      if opts.kdf == "pbkdf2" {
+        headers = append(headers, "Iterations: " + strconv.Itoa(opts.iterations))
+      }
+      if opts.keyLen != 16 {
+        headers = append(headers, "Key-Length: " + strconv.Itoa(opts.keyLen))
+      }
+    }
   } else {
-    output = decrypt(args)
+    if *armorFlag {
+      usage()
+    }
+    output = decrypt(opts)
+  }
+  if *armorFlag {
+    ioutil.WriteFile(*outputFileFlag, armor(headers, output), 0644)
+    return
   }
   outputToFile := make([]byte, hex.EncodedLen(len(output)))
   hex.Encode(outputToFile, output)
-  ioutil.WriteFile(args[6], outputToFile, 0644)
+  for i := len(headers) - 1; i >= 0; i-- {
+    outputToFile = append([]byte(headers[i] + "\n"), outputToFile...)
+  }
+  ioutil.WriteFile(*outputFileFlag, outputToFile, 0644)
+}
+
+func usage() {
+  fmt.Println(
+    `usage: ./encrypt-auth [operation] -k <32, 48 or 64-byte-long key in hex representation> | -enc-key <16, 24 or 32-byte-long key in hex> -mac-key <key in hex>
+                      | -kdf hkdf -k <master key in hex> | -password <password> [-iterations <n>] [-key-len 16|24|32]
+                      -i <input file name> -o <output file name> [-scheme mte|etm|eam|gcm|tls|none] [-mode cbc|cs3|ctr|cfb|ofb|ecb] [-aad <associated data in hex>] [-iv-key] [-mac hmac|naive] [-sha256 std|scratch] [-aes std|scratch] [-aes-trace]
+                      [-container] [-key-id <name>] [-armor]
+    [operation]: encrypt or decrypt
+    `)
+  os.Exit(1)
+}
+
+/*
+Enc_key and Mac_key, either from a combined key `key` of 32, 48 or 64 bytes,
+split in half for AES-128, -192 or -256, or given apart as `encKeyHex` and
+`macKeyHex`. Returns false unless exactly one of the two ways is used and the
+lengths fit.
+*/
+func splitKey(key, encKeyHex, macKeyHex string) ([]byte, []byte, bool) {
+  if key != "" {
+    combined, err := hex.DecodeString(key)
+    if err != nil || encKeyHex != "" || macKeyHex != "" || !(len(combined) == 32 || len(combined) == 48 || len(combined) == 64) {
+      return nil, nil, false
+    }
+    return combined[:len(combined) / 2], combined[len(combined) / 2:], true
+  }
+  encKey, err := hex.DecodeString(encKeyHex)
+  if err != nil || !(len(encKey) == 16 || len(encKey) == 24 || len(encKey) == 32) {
+    return nil, nil, false
+  }
+  macKey, err := hex.DecodeString(macKeyHex)
+  if err != nil || len(macKey) == 0 {
+    return nil, nil, false
+  }
+  return encKey, macKey, true
+}
+
+/*
+Enc_key and Mac_key for `opts`, calling usage() when the key material given
+does not fit its KDF. split takes the keys as they are, see `splitKey`. hkdf
+runs the master key -k through HKDF with the salt, and pbkdf2 stretches the
+password with PBKDF2 into 32 bytes that go straight to HKDF-Expand: they are
+uniformly random already. Either way the two keys come out of the one secret
+under different labels, so neither tells anything about the other.
+*/
+func deriveKeys(opts options) ([]byte, []byte) {
+  if opts.kdf == "split" {
+    encKey, macKey, ok := splitKey(opts.key, opts.encKeyHex, opts.macKeyHex)
+    if !ok || opts.password != "" {
+      usage()
+    }
+    return encKey, macKey
+  }
+  if opts.encKeyHex != "" || opts.macKeyHex != "" {
+    usage()
+  }
+  var prk []byte
+  if opts.kdf == "pbkdf2" {
+    if opts.password == "" || opts.key != "" {
+      usage()
+    }
+    prk = pbkdf2([]byte(opts.password), opts.salt, opts.iterations, 32)
+  } else {
+    master, err := hex.DecodeString(opts.key)
+    if err != nil || len(master) < 16 || opts.password != "" {
+      usage()
+    }
+    prk = hkdfExtract(opts.salt, master)
+  }
+  return hkdfExpand(prk, []byte("encrypt-auth encryption key"), opts.keyLen), hkdfExpand(prk, []byte("encrypt-auth MAC key"), 32)
+}
+
+/*
+The header of a versioned container for the output of `opts`. It starts with
+the magic and the version, and records everything decryption needs, defaults
+included, so that nothing has to be known out of band but the key: the scheme,
+mode, padding and MAC, where the IV comes from, the key length, the tag length
+and how the keys were derived. Ordinary files leave out whatever is default.
+*/
+func containerHeaders(opts options) []string {
+  iv := "random"
+  if opts.ivKey {
+    iv = "key"
+  } else if opts.mode == "ecb" {
+    iv = "none"
+  }
+  headers := []string{
+    "Container: " + containerMagic + " " + strconv.Itoa(containerVersion),
+    "Scheme: " + opts.scheme,
+    "Mode: " + opts.mode,
+    "Padding: " + opts.padding,
+    "MAC: " + opts.mac,
+    "IV: " + iv,
+    "Key-Length: " + strconv.Itoa(opts.keyLen),
+    "Tag-Length: " + strconv.Itoa(tagLength(opts.scheme)),
+    "KDF: " + opts.kdf,
+  }
+  if opts.kdf != "split" {
+    headers = append(headers, "Salt: " + hex.EncodeToString(opts.salt))
+  }
+  if opts.kdf == "pbkdf2" {
+    headers = append(headers, "Iterations: " + strconv.Itoa(opts.iterations))
+  }
+  if opts.keyID != "" {
+    headers = append(headers, "Key-ID: " + opts.keyID)
+  }
+  return headers
+}
+
+// the length of the tag `scheme` adds: HMAC-SHA256, the GCM tag, or none
+func tagLength(scheme string) int {
+  switch scheme {
+  case "gcm":
+    return 16
+  case "none":
+    return 0
+  }
+  return 32
+}
+
+/*
+Check the "Container:" line a versioned container starts with, if `headers`
+has one: the magic has to be right and the version one this program reads.
+Files without it are read the way they always were.
+*/
+func checkContainer(headers map[string]string) {
+  container, ok := headers["Container"]
+  if !ok {
+    return
+  }
+  fields := strings.Fields(container)
+  if len(fields) != 2 || fields[0] != containerMagic {
+    fmt.Println("Input file is not an encrypt-auth container.")
+    os.Exit(1)
+  }
+  if fields[1] != strconv.Itoa(containerVersion) {
+    fmt.Printf("Input file is a version %s container, this program reads version %d.\n", fields[1], containerVersion)
+    os.Exit(1)
+  }
+}
+
+/*
+CRC-24 of OpenPGP (RFC 4880, section 6.1), the checksum at the foot of an
+armored file.
+*/
+func crc24(data []byte) uint32 {
+  crc := uint32(0xb704ce)
+  for _, b := range data {
+    crc ^= uint32(b) << 16
+    for i := 0; i < 8; i++ {
+      crc <<= 1
+      if crc & 0x1000000 != 0 {
+        crc ^= 0x1864cfb
+      }
+    }
+  }
+  return crc & 0xffffff
+}
+
+/*
+Wrap `body` in ASCII armor, laid out like OpenPGP's: the BEGIN line, the
+`headers`, a blank line, the body in base64 64 characters to a line, its CRC-24
+in base64 after a "=", and the END line. Unlike one long line of hex, this
+survives being pasted into a mail or a chat.
+*/
+func armor(headers []string, body []byte) []byte {
+  var buf bytes.Buffer
+  buf.WriteString(armorBegin + "\n")
+  for _, header := range headers {
+    buf.WriteString(header + "\n")
+  }
+  buf.WriteString("\n")
+  encoded := base64.StdEncoding.EncodeToString(body)
+  for len(encoded) > 64 {
+    buf.WriteString(encoded[:64] + "\n")
+    encoded = encoded[64:]
+  }
+  if encoded != "" {
+    buf.WriteString(encoded + "\n")
+  }
+  crc := crc24(body)
+  buf.WriteString("=" + base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) + "\n")
+  buf.WriteString(armorEnd + "\n")
+  return buf.Bytes()
+}
+
+/*
+Turn an armored file back into header lines followed by hex, the form the rest
+of the program reads. Anything else is returned as it is. Exits when the armor
+is broken or the checksum does not match, which is what a line lost or mangled
+in pasting looks like.
+*/
+func dearmor(data []byte) []byte {
+  text := strings.TrimSpace(strings.Replace(string(data), "\r\n", "\n", -1))
+  if !strings.HasPrefix(text, armorBegin + "\n") {
+    return data
+  }
+  lines := strings.Split(text, "\n")
+  if lines[len(lines) - 1] != armorEnd {
+    fmt.Println("Input file is armored but has no END line.")
+    os.Exit(1)
+  }
+  lines = lines[1 : len(lines) - 1]
+  // the headers run up to the first blank line
+  var res []byte
+  i := 0
+  for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+    res = append(res, lines[i] + "\n"...)
+  }
+  var body, checksum string
+  for _, line := range lines[i:] {
+    line = strings.TrimSpace(line)
+    if strings.HasPrefix(line, "=") {
+      checksum = line[1:]
+    } else {
+      body += line
+    }
+  }
+  raw, err := base64.StdEncoding.DecodeString(body)
+  sum, errSum := base64.StdEncoding.DecodeString(checksum)
+  if err != nil || errSum != nil || len(sum) != 3 || crc24(raw) != uint32(sum[0]) << 16 | uint32(sum[1]) << 8 | uint32(sum[2]) {
+    fmt.Println("Input file is armored, but its body does not match the checksum.")
+    os.Exit(1)
+  }
+  return append(res, hex.EncodeToString(raw)...)
 }
 
 /*
 Main function that deals with encryption process. Calls into numerous 
 subroutines.
-Takes as arguments all the command line arguments `args`. Return a byte slice
+Takes as argument the options given on the command line. Return a byte slice
 that can be written into a file.
 */
-func encrypt(args []string) []byte {
-  keyStr, inputFile := args[2], args[4]
-  data, err := ioutil.ReadFile(inputFile)
+func encrypt(opts options) []byte {
+  data, err := ioutil.ReadFile(opts.inputFile)
   check(err)
   if len(data) % 2 != 0 {
     fmt.Println("Invalid plaintext file: octet representation only.")
@@ -61,33 +471,138 @@ func encrypt(args []string) []byte {
   plaintext := make([]byte, hex.DecodedLen(len(data)))
   _, err = hex.Decode(plaintext, data)
   check(err)
-  key := make([]byte, 32)
-  _, err = hex.Decode(key, []byte(keyStr))
-  // split key
-  encKey, macKey := key[:16], key[16:]
-  // calculate HMAC on M with `macKey` to get a tag
-  hmacTag := hmac(plaintext, macKey)
+  encKey, macKey := deriveKeys(opts)
+  switch opts.scheme {
+  case "etm":
+    // encrypt first, then calculate the tag over the whole of IV||C'
+    cipherTextWithIV := encryptBody(opts, plaintext, encKey)
+    return append(cipherTextWithIV, computeTag(opts, cipherTextWithIV, macKey)...)
+  case "eam":
+    // the tag is calculated on M and sent in the clear next to the ciphertext
+    hmacTag := computeTag(opts, plaintext, macKey)
+    return append(encryptBody(opts, plaintext, encKey), hmacTag...)
+  case "gcm":
+    // AES-GCM provides both confidentiality and integrity by itself, so only
+    // `encKey` is used and there is no padding at all
+    return gcmSeal(plaintext, encKey, opts.aad)
+  case "none":
+    // no tag: anyone can edit the ciphertext, see cbc-bitflip
+    return encryptBody(opts, plaintext, encKey)
+  case "tls":
+    // MAC-then-encrypt as TLS does it in CBC mode: the tag also covers a
+    // sequence number, and the padding bytes hold the padding length minus one
+    opts.padding = "tls"
+    return encryptBody(opts, append(plaintext, tlsMAC(plaintext, macKey)...), encKey)
+  }
+  // calculate HMAC on M, and the associated data if any, with `macKey` to get
+  // a tag
+  hmacTag := computeTag(opts, macInput(opts.aad, plaintext), macKey)
   // append the tag to the original plaintext message
   plainTextWithTag := append(plaintext, hmacTag...)
-  // do the PS padding
-  paddedPlainTextWithTag := psPad(plainTextWithTag)
-  // do AES CBC mode encryption to get a ciphertext. Return the IV meanwhile
-  IV, cipherText := aes_cbc_enc(paddedPlainTextWithTag, encKey)
-  // append the ciphertext with IV, and return
+  // do the PS padding (CBC only) and AES encryption to get a ciphertext, and
+  // return it with the IV in front
+  return encryptBody(opts, plainTextWithTag, encKey)
+}
+
+/*
+Encrypt `text` in the mode and with the padding of `opts`, and return IV||C'.
+With -iv-key the key itself is the IV, or its first 16 bytes for longer keys.
+The receiver knows it already, so only C' is returned.
+*/
+func encryptBody(opts options, text, encKey []byte) []byte {
+  if opts.ivKey {
+    return aes_cbc_enc_iv(pad(text, opts.padding), encKey, encKey)
+  }
+  IV, cipherText := encryptMode(opts.mode, opts.padding, text, encKey)
   return append(IV, cipherText...)
 }
 
 /*
 Main function that deals with decryption process. Calls into numerous 
 subroutines.
-Takes as arguments all the command line arguments `args`. Return a byte slice
+Takes as argument the options given on the command line. Return a byte slice
 that can be written into a file.
 */
 
-func decrypt(args []string) []byte {
-  keyStr, inputFile := args[2], args[4]
-  data, err := ioutil.ReadFile(inputFile)
+func decrypt(opts options) []byte {
+  data, err := ioutil.ReadFile(opts.inputFile)
   check(err)
+  data = dearmor(data)
+  // pick up the scheme recorded by encryption, unless one is given explicitly
+  headers, data := parseHeaders(data)
+  checkContainer(headers)
+  if opts.scheme == "" {
+    opts.scheme = headers["Scheme"]
+  } else if headers["Scheme"] != "" && headers["Scheme"] != opts.scheme {
+    fmt.Printf("Input file was encrypted with scheme %s, not %s.\n", headers["Scheme"], opts.scheme)
+    os.Exit(1)
+  }
+  if opts.scheme == "" {
+    opts.scheme = "mte"
+  }
+  if opts.mode == "" {
+    opts.mode = headers["Mode"]
+  } else if headers["Mode"] != "" && headers["Mode"] != opts.mode {
+    fmt.Printf("Input file was encrypted with mode %s, not %s.\n", headers["Mode"], opts.mode)
+    os.Exit(1)
+  }
+  if opts.mode == "" {
+    opts.mode = "cbc"
+  }
+  if opts.padding == "" {
+    opts.padding = headers["Padding"]
+  } else if headers["Padding"] != "" && headers["Padding"] != opts.padding {
+    fmt.Printf("Input file was encrypted with padding %s, not %s.\n", headers["Padding"], opts.padding)
+    os.Exit(1)
+  }
+  if opts.padding == "" {
+    opts.padding = "pkcs7"
+  }
+  if opts.mac == "" {
+    opts.mac = headers["MAC"]
+  } else if headers["MAC"] != "" && headers["MAC"] != opts.mac {
+    fmt.Printf("Input file was authenticated with MAC %s, not %s.\n", headers["MAC"], opts.mac)
+    os.Exit(1)
+  }
+  if opts.mac == "" {
+    opts.mac = "hmac"
+  }
+  if opts.mac != "hmac" && !(opts.scheme == "mte" || opts.scheme == "etm" || opts.scheme == "eam") {
+    usage()
+  }
+  opts.ivKey = opts.ivKey || headers["IV"] == "key"
+  if opts.kdf == "" {
+    opts.kdf = headers["KDF"]
+  } else if headers["KDF"] != "" && headers["KDF"] != opts.kdf {
+    fmt.Printf("Input file was encrypted with keys from KDF %s, not %s.\n", headers["KDF"], opts.kdf)
+    os.Exit(1)
+  }
+  if opts.kdf == "" {
+    opts.kdf = "split"
+  }
+  if !(opts.kdf == "split" || opts.kdf == "hkdf" || opts.kdf == "pbkdf2") {
+    fmt.Printf("Input file was encrypted with keys from an unknown KDF %s.\n", opts.kdf)
+    os.Exit(1)
+  }
+  // the derivation is repeated with the salt, iteration count and key length
+  // encryption recorded
+  if opts.kdf != "split" {
+    salt, err := hex.DecodeString(headers["Salt"])
+    iterations, errIterations := strconv.Atoi(headers["Iterations"])
+    keyLen, errKeyLen := strconv.Atoi(headers["Key-Length"])
+    if headers["Key-Length"] == "" {
+      keyLen, errKeyLen = 16, nil
+    }
+    if err != nil || len(salt) == 0 || opts.kdf == "pbkdf2" && (errIterations != nil || iterations < 1) || errKeyLen != nil || !(keyLen == 16 || keyLen == 24 || keyLen == 32) {
+      fmt.Println("Input file does not record the salt, iteration count and key length the keys were derived with.")
+      os.Exit(1)
+    }
+    opts.salt, opts.iterations, opts.keyLen = salt, iterations, keyLen
+  }
+  if len(opts.aad) != 0 && opts.scheme != "gcm" && opts.scheme != "mte" || opts.mode != "cbc" && opts.scheme == "gcm" || opts.padding != "pkcs7" && (opts.mode != "cbc" && opts.mode != "ecb" || opts.scheme == "gcm") ||
+    opts.ivKey && (opts.mode != "cbc" || opts.scheme == "gcm") || opts.scheme == "tls" && (opts.mode != "cbc" || opts.padding != "pkcs7") {
+    usage()
+  }
   if len(data) % 2 != 0 {
     fmt.Println("Invalid plaintext file: octet representation only.")
     os.Exit(1)
@@ -96,21 +611,76 @@ func decrypt(args []string) []byte {
   cipherTextWithIV := make([]byte, hex.DecodedLen(len(data)))
   _, err = hex.Decode(cipherTextWithIV, data)
   check(err)
-  key := make([]byte, 32)
-  _, err = hex.Decode(key, []byte(keyStr))
-  // split key
-  encKey, macKey := key[:16], key[16:]
+  encKey, macKey := deriveKeys(opts)
+  // a container says which key and how long a tag to expect, so a mismatch is
+  // reported as such rather than as a failed MAC
+  if headers["Container"] != "" {
+    if headers["Key-Length"] != strconv.Itoa(len(encKey)) {
+      fmt.Printf("Input file was encrypted with a %s-byte key, not a %d-byte one.\n", headers["Key-Length"], len(encKey))
+      os.Exit(1)
+    }
+    if headers["Tag-Length"] != strconv.Itoa(tagLength(opts.scheme)) {
+      fmt.Printf("Input file records a %s-byte tag, the %s scheme has %d-byte ones.\n", headers["Tag-Length"], opts.scheme, tagLength(opts.scheme))
+      os.Exit(1)
+    }
+    if opts.keyID != "" && headers["Key-ID"] != opts.keyID {
+      fmt.Printf("Input file was encrypted under key %q, not %q.\n", headers["Key-ID"], opts.keyID)
+      os.Exit(1)
+    }
+  }
+  if opts.scheme == "gcm" {
+    return gcmOpen(cipherTextWithIV, encKey, opts.aad)
+  }
+  if opts.scheme == "none" {
+    if len(cipherTextWithIV) < 16 {
+      fmt.Println("Invalid ciphertext file: too short.")
+      os.Exit(1)
+    }
+    // whatever decrypts with valid padding is taken as it is
+    IV, cipherText := splitIV(opts, cipherTextWithIV, encKey)
+    return decryptMode(opts.mode, opts.padding, cipherText, encKey, IV)
+  }
+  if opts.scheme == "tls" {
+    opts.padding = "tls"
+  }
+  if opts.scheme == "etm" || opts.scheme == "eam" {
+    if len(cipherTextWithIV) < 48 {
+      fmt.Println("Invalid ciphertext file: too short.")
+      os.Exit(1)
+    }
+    n := len(cipherTextWithIV)
+    cipherTextWithIV, tag := cipherTextWithIV[:n - 32], cipherTextWithIV[n - 32:]
+    // with encrypt-then-MAC nothing is decrypted before the tag checks out,
+    // so a tampered ciphertext never reaches the padding check
+    if opts.scheme == "etm" && !reflect.DeepEqual(tag, computeTag(opts, cipherTextWithIV, macKey)) {
+      fmt.Println("INVALID MAC")
+      os.Exit(1)
+    }
+    IV, cipherText := splitIV(opts, cipherTextWithIV, encKey)
+    plainText := decryptMode(opts.mode, opts.padding, cipherText, encKey, IV)
+    if opts.scheme == "eam" && !reflect.DeepEqual(tag, computeTag(opts, plainText, macKey)) {
+      fmt.Println("INVALID MAC")
+      os.Exit(1)
+    }
+    return plainText
+  }
   // parse C to get C' and IV
-  IV, cipherText := cipherTextWithIV[:16], cipherTextWithIV[16:]
-  // do the AES CBC decryption first, as in a reverse order from encryption
-  plainTextPadded := aes_cbc_dec(cipherText, encKey, IV)
-  // remove the PS padding from M'' to get M'
-  dePaddedPlainText := stripPadding(plainTextPadded)
+  IV, cipherText := splitIV(opts, cipherTextWithIV, encKey)
+  // do the AES decryption first, as in a reverse order from encryption, and
+  // remove the PS padding from M'' to get M' (CBC only)
+  dePaddedPlainText := decryptMode(opts.mode, opts.padding, cipherText, encKey, IV)
+  if len(dePaddedPlainText) < 32 {
+    fmt.Println("INVALID MAC")
+    os.Exit(1)
+  }
   // parse the resultant M' to get the delivered tag T, and the original message
   plainText, tag := dePaddedPlainText[:len(dePaddedPlainText) - 32], 
     dePaddedPlainText[len(dePaddedPlainText) - 32:]
   // Use HMAC to calculate a new Tag on the message
-  newTag := hmac(plainText, macKey)
+  newTag := computeTag(opts, macInput(opts.aad, plainText), macKey)
+  if opts.scheme == "tls" {
+    newTag = tlsMAC(plainText, macKey)
+  }
   // Compare with the delivered tag, report error if mismatch
   if !reflect.DeepEqual(tag, newTag) {
     fmt.Println("INVALID MAC")
@@ -120,16 +690,76 @@ func decrypt(args []string) []byte {
   return plainText
 }
 
+/*
+AES-GCM encryption of `text` with the key `encKey`. `aad` is authenticated
+along with the text but not encrypted. A random 96-bit nonce is drawn for every
+message. Returns nonce||ciphertext||tag.
+*/
+func gcmSeal(text, encKey, aad []byte) []byte {
+  block, err := newAES(encKey)
+  check(err)
+  gcm, err := cipher.NewGCM(block)
+  check(err)
+  nonce := make([]byte, gcm.NonceSize())
+  _, err = rand.Read(nonce)
+  check(err)
+  return gcm.Seal(nonce, nonce, text, aad)
+}
+
+/*
+AES-GCM decryption of nonce||ciphertext||tag. Any tampering with the nonce,
+the ciphertext, the tag or the associated data shows up as the same
+authentication failure.
+*/
+func gcmOpen(cipherText, encKey, aad []byte) []byte {
+  block, err := newAES(encKey)
+  check(err)
+  gcm, err := cipher.NewGCM(block)
+  check(err)
+  if len(cipherText) < gcm.NonceSize() + gcm.Overhead() {
+    fmt.Println("AUTHENTICATION FAILED")
+    os.Exit(1)
+  }
+  nonce, cipherText := cipherText[:gcm.NonceSize()], cipherText[gcm.NonceSize():]
+  plainText, err := gcm.Open(nil, nonce, cipherText, aad)
+  if err != nil {
+    fmt.Println("AUTHENTICATION FAILED")
+    os.Exit(1)
+  }
+  return plainText
+}
+
+/*
+Split the "Name: value" header lines off the front of a file. Returns the
+headers found and the rest of the file, which is the hex formatted data.
+*/
+func parseHeaders(data []byte) (map[string]string, []byte) {
+  headers := make(map[string]string)
+  for {
+    end := bytes.IndexByte(data, '\n')
+    if end < 0 {
+      break
+    }
+    line := string(data[:end])
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+      break
+    }
+    headers[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon + 1:])
+    data = data[end + 1:]
+  }
+  return headers, data
+}
+
 /*
 Function that does HMAC. Takes as arguments the input text, and the key used
-for this MAC. SHA256 is used as the helper hash function.
+for this MAC. SHA256 (see `sha256Sum`) is used as the helper hash function.
 */
 func hmac(text []byte, key []byte) []byte {
   B := 64
   // if key is too long, hash it first
   if len(key) > B {
-    keyHashed := sha256.Sum256(key)
-    key = keyHashed[0:]
+    key = sha256Sum(key)
   }
   // if key is too short, pad 0x00 to the end first to B-byte length
   if len(key) < B {
@@ -140,23 +770,439 @@ func hmac(text []byte, key []byte) []byte {
     }
     key = append(key, pad...)
   }
-  // tmp1, tmp2, hash1, hash2 are just intermediate values during calculation
+  // tmp1, tmp2 are just intermediate values during calculation
   tmp1 := make([]byte, B)
   // xor with ipad first
   for i := range tmp1 {
     tmp1[i] = key[i] ^ 0x36
   }
   // first level hash on the result
-  hash1 := sha256.Sum256(append(tmp1, text...))
-  tmp1 = hash1[0:]
+  tmp1 = sha256Sum(append(tmp1, text...))
   tmp2 := make([]byte, B)
   // do a second xor with opad
   for i := range tmp2 {
     tmp2[i] = key[i] ^ 0x5C
   }
   // hash again
-  hash2 := sha256.Sum256(append(tmp2, tmp1...))
-  return hash2[0:]
+  return sha256Sum(append(tmp2, tmp1...))
+}
+
+/*
+HKDF-Extract of RFC 5869: concentrate the entropy of the input keying material
+`ikm` into a pseudorandom key, HMAC(salt, ikm).
+*/
+func hkdfExtract(salt, ikm []byte) []byte {
+  return hmac(ikm, salt)
+}
+
+/*
+HKDF-Expand of RFC 5869: stretch the pseudorandom key `prk` to `length` bytes
+bound to the label `info`, as T(1) || T(2) || ... with
+  T(i) = HMAC(prk, T(i-1) || info || i)
+and T(0) empty.
+*/
+func hkdfExpand(prk, info []byte, length int) []byte {
+  var res, t []byte
+  for i := 1; len(res) < length; i++ {
+    block := append(append(append([]byte{}, t...), info...), byte(i))
+    t = hmac(block, prk)
+    res = append(res, t...)
+  }
+  return res[:length]
+}
+
+/*
+PBKDF2 of RFC 8018 with HMAC-SHA256: stretch `password` into `keyLen` bytes,
+made slow on purpose by `iterations` rounds of HMAC per 32-byte block, so that
+every password guess costs an attacker as much. Block i is
+  U_1 ^ U_2 ^ ... ^ U_iterations
+with U_1 = HMAC(password, salt || i) and U_j = HMAC(password, U_(j-1)).
+*/
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+  var res []byte
+  for i := 1; len(res) < keyLen; i++ {
+    index := make([]byte, 4)
+    binary.BigEndian.PutUint32(index, uint32(i))
+    u := hmac(append(append([]byte{}, salt...), index...), password)
+    block := append([]byte{}, u...)
+    for j := 1; j < iterations; j++ {
+      u = hmac(u, password)
+      for k := range block {
+        block[k] ^= u[k]
+      }
+    }
+    res = append(res, block...)
+  }
+  return res[:keyLen]
+}
+
+/*
+The tag on `text` with the MAC of `opts`: HMAC-SHA256, or for -mac naive the
+plain SHA256(key || text). The naive one lets anyone who has seen a tag compute
+the tag of the text with more appended, see length-extension.
+*/
+func computeTag(opts options, text, macKey []byte) []byte {
+  if opts.mac == "naive" {
+    return sha256Sum(append(append([]byte{}, macKey...), text...))
+  }
+  return hmac(text, macKey)
+}
+
+/*
+What the mte scheme's tag covers: the associated data `aad`, prefixed with its
+length as an 8-byte big-endian integer, then the message. The length fixes
+where the associated data ends, so no bytes can be moved across that boundary
+without changing the tag. The length is there even when `aad` is empty, as
+eight zero bytes, so that no associated data cannot be confused with associated
+data that happens to hold what the message starts with. Files tagged over the
+message alone, as they were before associated data came in, no longer verify.
+*/
+func macInput(aad, text []byte) []byte {
+  prefix := make([]byte, 8)
+  binary.BigEndian.PutUint64(prefix, uint64(len(aad)))
+  return append(append(prefix, aad...), text...)
+}
+
+/*
+The tag of a TLS record: HMAC over the 8-byte sequence number followed by the
+message. Every file holds a single record, so the sequence number is always 0.
+*/
+func tlsMAC(text, macKey []byte) []byte {
+  return hmac(append(make([]byte, 8), text...), macKey)
+}
+
+/*
+SHA-256 of `data`, with the implementation `sha256Impl` selects: std for Go's
+crypto/sha256, scratch for the hand-written `sha256Digest` below.
+*/
+func sha256Sum(data []byte) []byte {
+  if sha256Impl == "scratch" {
+    d := newSHA256()
+    d.write(data)
+    return d.sum()
+  }
+  sum := sha256.Sum256(data)
+  return sum[:]
+}
+
+/*
+SHA-256 written out by hand, following FIPS 180-4. The internal state is left
+in the open: `h` is the chaining value after the first `length` bytes written,
+less the ones in `buf`, which are waiting for a whole 64-byte block. Setting
+`h` and `length` to a hash and the length it covered carries that hash on.
+*/
+type sha256Digest struct {
+  h [8]uint32
+  buf []byte
+  length uint64
+}
+
+// initial chaining value: the first 32 bits of the fractional parts of the
+// square roots of the first 8 primes
+var sha256H0 = [8]uint32{
+  0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+// round constants: the first 32 bits of the fractional parts of the cube
+// roots of the first 64 primes
+var sha256K = [64]uint32{
+  0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+  0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+  0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+  0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+  0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+  0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+  0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+  0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+}
+
+func newSHA256() *sha256Digest {
+  return &sha256Digest{h: sha256H0}
+}
+
+// hash `data`, one 64-byte block at a time
+func (d *sha256Digest) write(data []byte) {
+  d.length += uint64(len(data))
+  d.buf = append(d.buf, data...)
+  for len(d.buf) >= 64 {
+    sha256Compress(&d.h, d.buf[:64])
+    d.buf = d.buf[64:]
+  }
+}
+
+/*
+The hash of everything written so far. The message is padded with 0x80, zeros
+up to 8 bytes short of a whole block, and the length in bits as a 64-bit
+big-endian integer. This works on a copy of the state, so more can be written
+afterwards.
+*/
+func (d *sha256Digest) sum() []byte {
+  h := d.h
+  rest := append(append([]byte{}, d.buf...), 0x80)
+  for len(rest) % 64 != 56 {
+    rest = append(rest, 0)
+  }
+  bitLen := make([]byte, 8)
+  binary.BigEndian.PutUint64(bitLen, d.length * 8)
+  rest = append(rest, bitLen...)
+  for i := 0; i < len(rest); i += 64 {
+    sha256Compress(&h, rest[i : i + 64])
+  }
+  res := make([]byte, 32)
+  for i := range h {
+    binary.BigEndian.PutUint32(res[4 * i:], h[i])
+  }
+  return res
+}
+
+/*
+The SHA-256 compression function (FIPS 180-4, section 6.2.2): mix one 64-byte
+block into the chaining value `h`.
+*/
+func sha256Compress(h *[8]uint32, block []byte) {
+  // message schedule
+  var w [64]uint32
+  for t := 0; t < 16; t++ {
+    w[t] = binary.BigEndian.Uint32(block[4 * t:])
+  }
+  for t := 16; t < 64; t++ {
+    s0 := bits.RotateLeft32(w[t - 15], -7) ^ bits.RotateLeft32(w[t - 15], -18) ^ (w[t - 15] >> 3)
+    s1 := bits.RotateLeft32(w[t - 2], -17) ^ bits.RotateLeft32(w[t - 2], -19) ^ (w[t - 2] >> 10)
+    w[t] = w[t - 16] + s0 + w[t - 7] + s1
+  }
+  a, b, c, d, e, f, g, hh := h[0], h[1], h[2], h[3], h[4], h[5], h[6], h[7]
+  for t := 0; t < 64; t++ {
+    S1 := bits.RotateLeft32(e, -6) ^ bits.RotateLeft32(e, -11) ^ bits.RotateLeft32(e, -25)
+    ch := (e & f) ^ (^e & g)
+    t1 := hh + S1 + ch + sha256K[t] + w[t]
+    S0 := bits.RotateLeft32(a, -2) ^ bits.RotateLeft32(a, -13) ^ bits.RotateLeft32(a, -22)
+    maj := (a & b) ^ (a & c) ^ (b & c)
+    t2 := S0 + maj
+    hh, g, f, e, d, c, b, a = g, f, e, d + t1, c, b, a, t1 + t2
+  }
+  h[0] += a
+  h[1] += b
+  h[2] += c
+  h[3] += d
+  h[4] += e
+  h[5] += f
+  h[6] += g
+  h[7] += hh
+}
+
+/*
+The AES block cipher, with the implementation `aesImpl` selects: std for Go's
+crypto/aes, scratch for the hand-written `scratchAES` below.
+*/
+func newAES(key []byte) (cipher.Block, error) {
+  if aesImpl == "scratch" {
+    c, err := newScratchAES(key, aesTrace)
+    if err != nil {
+      return nil, err
+    }
+    return c, nil
+  }
+  return aes.NewCipher(key)
+}
+
+/*
+AES written out by hand, following FIPS-197, for 16, 24 and 32-byte keys. It
+is a cipher.Block like the one crypto/aes gives, so every mode can run on it.
+The state is kept in input order: byte r + 4c is row r of column c. With
+`trace` set, every step of every round is printed the way Appendix C of
+FIPS-197 lists them, so a block can be followed against the standard line by
+line.
+*/
+type scratchAES struct {
+  // the expanded key, four words per round key
+  w []uint32
+  rounds int
+  trace bool
+}
+
+// the S-box and its inverse, worked out in `init`
+var sbox, invSbox [256]byte
+
+/*
+Build the S-box from its definition rather than copying the table: the
+multiplicative inverse in GF(2^8), with 0 going to 0, followed by the affine
+transformation b ^ rotl(b, 1) ^ rotl(b, 2) ^ rotl(b, 3) ^ rotl(b, 4) ^ 0x63.
+*/
+func init() {
+  for x := 0; x < 256; x++ {
+    // x^255 = 1 for every x but 0, so x^254 is the inverse, and 0^254 is 0
+    inv := byte(1)
+    for i := 0; i < 254; i++ {
+      inv = gmul(inv, byte(x))
+    }
+    if x == 0 {
+      inv = 0
+    }
+    s := inv ^ bits.RotateLeft8(inv, 1) ^ bits.RotateLeft8(inv, 2) ^ bits.RotateLeft8(inv, 3) ^ bits.RotateLeft8(inv, 4) ^ 0x63
+    sbox[x] = s
+    invSbox[s] = byte(x)
+  }
+}
+
+// multiplication in GF(2^8), modulo x^8 + x^4 + x^3 + x + 1
+func gmul(a, b byte) byte {
+  var res byte
+  for b != 0 {
+    if b & 1 != 0 {
+      res ^= a
+    }
+    // xtime: a times x
+    if a & 0x80 != 0 {
+      a = a << 1 ^ 0x1b
+    } else {
+      a <<= 1
+    }
+    b >>= 1
+  }
+  return res
+}
+
+/*
+Expand `key` into the round keys (FIPS-197, section 5.2). Every Nk-th word goes
+through RotWord, SubWord and the round constant, and with 256-bit keys the word
+halfway in between goes through SubWord as well.
+*/
+func newScratchAES(key []byte, trace bool) (*scratchAES, error) {
+  if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+    return nil, aes.KeySizeError(len(key))
+  }
+  nk := len(key) / 4
+  rounds := nk + 6
+  w := make([]uint32, 4 * (rounds + 1))
+  for i := 0; i < nk; i++ {
+    w[i] = binary.BigEndian.Uint32(key[4 * i:])
+  }
+  rcon := byte(1)
+  for i := nk; i < len(w); i++ {
+    temp := w[i - 1]
+    if i % nk == 0 {
+      temp = subWord(bits.RotateLeft32(temp, 8)) ^ uint32(rcon) << 24
+      rcon = gmul(rcon, 2)
+    } else if nk > 6 && i % nk == 4 {
+      temp = subWord(temp)
+    }
+    w[i] = w[i - nk] ^ temp
+  }
+  return &scratchAES{w, rounds, trace}, nil
+}
+
+// the S-box applied to each byte of `word`
+func subWord(word uint32) uint32 {
+  return uint32(sbox[word >> 24]) << 24 | uint32(sbox[word >> 16 & 0xff]) << 16 |
+    uint32(sbox[word >> 8 & 0xff]) << 8 | uint32(sbox[word & 0xff])
+}
+
+func (c *scratchAES) BlockSize() int {
+  return 16
+}
+
+// encrypt one block, the cipher of FIPS-197 section 5.1
+func (c *scratchAES) Encrypt(dst, src []byte) {
+  var state [16]byte
+  copy(state[:], src)
+  c.show(0, "input", state)
+  c.addRoundKey(&state, 0, 0, "k_sch")
+  for round := 1; round <= c.rounds; round++ {
+    c.show(round, "start", state)
+    subBytes(&state, &sbox)
+    c.show(round, "s_box", state)
+    shiftRows(&state, 1)
+    c.show(round, "s_row", state)
+    // the last round leaves out MixColumns
+    if round < c.rounds {
+      mixColumns(&state, [4]byte{2, 3, 1, 1})
+      c.show(round, "m_col", state)
+    }
+    c.addRoundKey(&state, round, round, "k_sch")
+  }
+  c.show(c.rounds, "output", state)
+  copy(dst, state[:])
+}
+
+/*
+Decrypt one block with the inverse cipher of FIPS-197 section 5.3: the steps of
+`Encrypt` undone in reverse order, with the round keys taken from the last.
+*/
+func (c *scratchAES) Decrypt(dst, src []byte) {
+  var state [16]byte
+  copy(state[:], src)
+  c.show(0, "iinput", state)
+  c.addRoundKey(&state, c.rounds, 0, "ik_sch")
+  for round := 1; round <= c.rounds; round++ {
+    c.show(round, "istart", state)
+    shiftRows(&state, 3)
+    c.show(round, "is_row", state)
+    subBytes(&state, &invSbox)
+    c.show(round, "is_box", state)
+    c.addRoundKey(&state, c.rounds - round, round, "ik_sch")
+    if round < c.rounds {
+      c.show(round, "ik_add", state)
+      mixColumns(&state, [4]byte{14, 11, 13, 9})
+    }
+  }
+  c.show(c.rounds, "ioutput", state)
+  copy(dst, state[:])
+}
+
+/*
+Xor round key `key` into the state. `round` and `step` are what the trace shows
+the key as, which differ from `key` in the inverse cipher.
+*/
+func (c *scratchAES) addRoundKey(state *[16]byte, key, round int, step string) {
+  var roundKey [16]byte
+  for col := 0; col < 4; col++ {
+    binary.BigEndian.PutUint32(roundKey[4 * col:], c.w[4 * key + col])
+  }
+  c.show(round, step, roundKey)
+  for i := range state {
+    state[i] ^= roundKey[i]
+  }
+}
+
+// each byte of the state replaced by its entry in `box`
+func subBytes(state *[16]byte, box *[256]byte) {
+  for i := range state {
+    state[i] = box[state[i]]
+  }
+}
+
+/*
+Rotate row r of the state left by r * `by` places: `by` is 1 for ShiftRows, and
+3, that is right by r, for InvShiftRows.
+*/
+func shiftRows(state *[16]byte, by int) {
+  old := *state
+  for r := 1; r < 4; r++ {
+    for col := 0; col < 4; col++ {
+      state[r + 4 * col] = old[r + 4 * ((col + r * by) % 4)]
+    }
+  }
+}
+
+/*
+Multiply each column of the state by the circulant matrix whose first row is
+`m`: 2 3 1 1 for MixColumns, 14 11 13 9 for InvMixColumns.
+*/
+func mixColumns(state *[16]byte, m [4]byte) {
+  for col := 0; col < 4; col++ {
+    var a [4]byte
+    copy(a[:], state[4 * col : 4 * col + 4])
+    for r := 0; r < 4; r++ {
+      state[r + 4 * col] = gmul(m[0], a[r]) ^ gmul(m[1], a[(r + 1) % 4]) ^ gmul(m[2], a[(r + 2) % 4]) ^ gmul(m[3], a[(r + 3) % 4])
+    }
+  }
+}
+
+// one line of the trace, as in FIPS-197 Appendix C
+func (c *scratchAES) show(round int, step string, state [16]byte) {
+  if c.trace {
+    fmt.Printf("round[%2d].%-9s %x\n", round, step, state)
+  }
 }
 
 /*
@@ -172,23 +1218,122 @@ func psPad(text []byte) []byte {
   return append(text, padding...)
 }
 
+/*
+Pad `text` to a multiple of the block size with the padding scheme `scheme`.
+Apart from zero padding, between 1 and 16 bytes are always added, and the last
+of them tells how many:
+  pkcs7   : every byte holds the padding length (this is what psPad does)
+  x923    : zeros, then the padding length (ANSI X9.23)
+  iso7816 : 0x80, then zeros (ISO/IEC 7816-4). The length is found by looking
+            for the 0x80 instead
+  iso10126: random bytes, then the padding length (ISO 10126)
+  zero    : zeros only, and nothing at all if the text fills the last block
+  tls     : every byte holds the padding length minus one (the tls scheme)
+*/
+func pad(text []byte, scheme string) []byte {
+  if scheme == "pkcs7" {
+    return psPad(text)
+  }
+  n := 16 - len(text) % 16
+  padding := make([]byte, n)
+  switch scheme {
+  case "x923":
+    padding[n - 1] = byte(n)
+  case "iso7816":
+    padding[0] = 0x80
+  case "iso10126":
+    _, err := rand.Read(padding[:n - 1])
+    check(err)
+    padding[n - 1] = byte(n)
+  case "tls":
+    for i := range padding {
+      padding[i] = byte(n - 1)
+    }
+  case "zero":
+    if n == 16 {
+      return text
+    }
+  }
+  return append(text, padding...)
+}
+
+/*
+Strip the padding added by `pad` with the scheme `scheme`, exiting when it is
+invalid. Only the bytes that the scheme fixes can be checked: ISO 10126 has
+just its last byte, and zero padding cannot be invalid at all. Zero padding is
+also ambiguous, as zero bytes at the end of the text itself are stripped too.
+*/
+func unpad(text []byte, scheme string) []byte {
+  n := len(text)
+  switch scheme {
+  case "pkcs7":
+    return stripPadding(text)
+  case "x923", "iso10126":
+    padLen := int(text[n - 1])
+    if padLen == 0 || padLen > 16 {
+      fmt.Println("Invalid Padding in Cipher Text, exiting")
+      os.Exit(1)
+    }
+    for i := 2; scheme == "x923" && i <= padLen; i++ {
+      if text[n - i] != 0 {
+        fmt.Println("Invalid Padding in Cipher Text, exiting")
+        os.Exit(1)
+      }
+    }
+    return text[:n - padLen]
+  case "iso7816":
+    // skip the zeros, what comes before them has to be the 0x80 marker
+    for i := 1; i <= 16; i++ {
+      if text[n - i] == 0x80 {
+        return text[:n - i]
+      }
+      if text[n - i] != 0 {
+        break
+      }
+    }
+    fmt.Println("Invalid Padding in Cipher Text, exiting")
+    os.Exit(1)
+  case "tls":
+    // TLS allows up to 256 bytes of padding, not just up to a block
+    padLen := int(text[n - 1]) + 1
+    for i := 1; i <= padLen; i++ {
+      if padLen > n || text[n - i] != text[n - 1] {
+        fmt.Println("Invalid Padding in Cipher Text, exiting")
+        os.Exit(1)
+      }
+    }
+    return text[:n - padLen]
+  }
+  for n > 0 && len(text) - n < 15 && text[n - 1] == 0 {
+    n--
+  }
+  return text[:n]
+}
+
 /*
 Do CBC mode encryption on the input `text`, with the key `encKey`. The S-block
 used is AES. Returns the encrypted text as well as IV. 
 */
 func aes_cbc_enc(text, encKey []byte) ([]byte, []byte) {
   // Get a random IV
-  cipherBlock := make([]byte, 16)
-  _, err := rand.Read(cipherBlock)
-  check(err)
-  // `cipherBlock` is a temp value used during calculation. `IV` is used to 
-  // store the initial seed
   IV := make([]byte, 16)
-  copy(IV, cipherBlock)
+  _, err := rand.Read(IV)
+  check(err)
+  return IV, aes_cbc_enc_iv(text, encKey, IV)
+}
+
+/*
+Do CBC mode encryption on the input `text`, with the key `encKey` and the given
+`IV`. Returns the encrypted text.
+*/
+func aes_cbc_enc_iv(text, encKey, IV []byte) []byte {
+  // `cipherBlock` is a temp value used during calculation
+  cipherBlock := make([]byte, 16)
+  copy(cipherBlock, IV)
 
   res := make([]byte, len(text))
   // get the AES cipher
-  cipher, err := aes.NewCipher(encKey)
+  cipher, err := newAES(encKey)
   check(err)
   // block by block calculation
   for i := 0; i < len(text) / 16; i++ {
@@ -198,7 +1343,7 @@ func aes_cbc_enc(text, encKey []byte) ([]byte, []byte) {
     cipher.Encrypt(cipherBlock, text[i * 16 : i * 16 + 16])
     copy(res[i * 16 : i * 16 + 16], cipherBlock)
   }
-  return IV, res
+  return res
 }
 
 /*
@@ -208,7 +1353,7 @@ Do CBC mode decryption on the input `cipherText`, with the key `encKey` and the
 func aes_cbc_dec(cipherText, encKey, IV []byte) []byte {
   // intermediate variable used during calculation. 
   plainBlock := make([]byte, len(IV))
-  cipher, err := aes.NewCipher(encKey)
+  cipher, err := newAES(encKey)
   check(err)
   for i := 0; i < len(cipherText) / 16; i++ {
     copy(plainBlock, cipherText[i * 16 : i * 16 + 16])
@@ -221,6 +1366,263 @@ func aes_cbc_dec(cipherText, encKey, IV []byte) []byte {
   return cipherText
 }
 
+/*
+Encrypt `text` with AES in the block cipher mode `mode`, under the key
+`encKey`. Returns the IV and the ciphertext. Only CBC and ECB need the text
+padded, with the padding scheme `padding`. CBC-CS3 steals ciphertext instead
+and the other modes turn AES into a stream cipher, so they keep the length as
+is. ECB has no IV, so an empty one is returned.
+*/
+func encryptMode(mode, padding string, text, encKey []byte) ([]byte, []byte) {
+  if mode == "cbc" {
+    return aes_cbc_enc(pad(text, padding), encKey)
+  }
+  if mode == "ecb" {
+    return nil, aes_ecb(pad(text, padding), encKey, true)
+  }
+  if mode == "cs3" {
+    // with less than a block there is nothing to steal from: the text would
+    // go out zero-filled and come back with the zeros still attached
+    if len(text) < 16 {
+      fmt.Println("Invalid plaintext file: cs3 mode needs at least 16 bytes to encrypt, use cbc for shorter messages.")
+      os.Exit(1)
+    }
+    return aes_cbc_cs3_enc(text, encKey)
+  }
+  IV := make([]byte, 16)
+  _, err := rand.Read(IV)
+  check(err)
+  switch mode {
+  case "ctr":
+    return IV, aes_ctr(text, encKey, IV)
+  case "cfb":
+    return IV, aes_cfb_enc(text, encKey, IV)
+  }
+  return IV, aes_ofb(text, encKey, IV)
+}
+
+/*
+Reverse of `encryptMode`: decrypt `cipherText` with the IV `IV` and strip the
+padding if the mode has one.
+*/
+func decryptMode(mode, padding string, cipherText, encKey, IV []byte) []byte {
+  switch mode {
+  case "ctr":
+    return aes_ctr(cipherText, encKey, IV)
+  case "cfb":
+    return aes_cfb_dec(cipherText, encKey, IV)
+  case "ofb":
+    return aes_ofb(cipherText, encKey, IV)
+  case "cs3":
+    if len(cipherText) < 16 {
+      fmt.Println("Invalid ciphertext file: shorter than one block.")
+      os.Exit(1)
+    }
+    return aes_cbc_cs3_dec(cipherText, encKey, IV)
+  }
+  if len(cipherText) == 0 || len(cipherText) % 16 != 0 {
+    fmt.Println("Invalid ciphertext file: not a whole number of blocks.")
+    os.Exit(1)
+  }
+  if mode == "ecb" {
+    return unpad(aes_ecb(cipherText, encKey, false), padding)
+  }
+  return unpad(aes_cbc_dec(cipherText, encKey, IV), padding)
+}
+
+/*
+Split IV||C' into the IV and the ciphertext. ECB has no IV, and with -iv-key
+the IV is a copy of `encKey`, its first 16 bytes for AES-192 and AES-256, so
+all of it is ciphertext.
+*/
+func splitIV(opts options, cipherTextWithIV, encKey []byte) ([]byte, []byte) {
+  if opts.mode == "ecb" {
+    return nil, cipherTextWithIV
+  }
+  if opts.ivKey {
+    IV := make([]byte, 16)
+    copy(IV, encKey)
+    return IV, cipherTextWithIV
+  }
+  return cipherTextWithIV[:16], cipherTextWithIV[16:]
+}
+
+/*
+Do ECB mode encryption (or decryption, if `encrypt` is false) on `text` with the
+key `encKey`: every block goes through AES on its own. Equal plaintext blocks
+give equal ciphertext blocks, which is what ecb-attack feeds on.
+*/
+func aes_ecb(text, encKey []byte, encrypt bool) []byte {
+  cipher, err := newAES(encKey)
+  check(err)
+  res := make([]byte, len(text))
+  for i := 0; i < len(text); i += 16 {
+    if encrypt {
+      cipher.Encrypt(res[i : i + 16], text[i : i + 16])
+    } else {
+      cipher.Decrypt(res[i : i + 16], text[i : i + 16])
+    }
+  }
+  return res
+}
+
+/*
+Do CBC mode encryption with ciphertext stealing, in the CS3 variant of NIST SP
+800-38A Addendum, on `text` of at least 16 bytes, which `encryptMode` makes
+sure of. The last partial block is filled up with zeros and everything is CBC
+encrypted as usual. Then the last two ciphertext blocks are swapped, and the
+block that now comes last is cut down to the length of the partial block: the
+cut-off bytes are not lost, they can be recovered from decrypting the final
+full block. The ciphertext is as long as the text and there is no padding to
+check.
+Returns the IV and the ciphertext.
+*/
+func aes_cbc_cs3_enc(text, encKey []byte) ([]byte, []byte) {
+  n := len(text)
+  // length of the last, possibly partial, block
+  d := n % 16
+  if d == 0 {
+    d = 16
+  }
+  filled := make([]byte, n + 16 - d)
+  copy(filled, text)
+  IV, cipherText := aes_cbc_enc(filled, encKey)
+  if len(cipherText) == 16 {
+    return IV, cipherText
+  }
+  m := len(cipherText)
+  res := make([]byte, 0, n)
+  res = append(res, cipherText[:m - 32]...)
+  res = append(res, cipherText[m - 16:]...)
+  return IV, append(res, cipherText[m - 32 : m - 32 + d]...)
+}
+
+/*
+Do CBC-CS3 decryption on `cipherText` with the key `encKey` and the `IV`.
+Decrypting the second to last (full) block gives the last plaintext bytes
+xor-ed with the stolen ciphertext block, whose missing tail shows up right
+where the zeros were. With that block restored, the rest is ordinary CBC.
+*/
+func aes_cbc_cs3_dec(cipherText, encKey, IV []byte) []byte {
+  n := len(cipherText)
+  if n == 16 {
+    return aes_cbc_dec(cipherText, encKey, IV)
+  }
+  d := n % 16
+  if d == 0 {
+    d = 16
+  }
+  cipher, err := newAES(encKey)
+  check(err)
+  // the block that was swapped to the second to last position
+  z := make([]byte, 16)
+  cipher.Decrypt(z, cipherText[n - 16 - d : n - d])
+  stolen := cipherText[n - d:]
+  lastPlain := make([]byte, d)
+  for j := range lastPlain {
+    lastPlain[j] = z[j] ^ stolen[j]
+  }
+  // put the stolen block back together and decrypt everything in front of it
+  restored := make([]byte, n - d)
+  copy(restored, cipherText[:n - 16 - d])
+  copy(restored[n - 16 - d:], stolen)
+  copy(restored[n - 16:], z[d:])
+  res := aes_cbc_dec(restored, encKey, IV)
+  return append(res, lastPlain...)
+}
+
+/*
+Do CTR mode encryption on `text` with the key `encKey`. The IV is the first
+counter block, and the counter is incremented as a 128-bit big-endian integer
+for every following block. Each encrypted counter block is a piece of key
+stream that is xor-ed with the text, so encryption and decryption are the very
+same operation.
+*/
+func aes_ctr(text, encKey, IV []byte) []byte {
+  cipher, err := newAES(encKey)
+  check(err)
+  counter := make([]byte, 16)
+  copy(counter, IV)
+  keyStream := make([]byte, 16)
+  res := make([]byte, len(text))
+  for i := 0; i < len(text); i += 16 {
+    cipher.Encrypt(keyStream, counter)
+    // the last block may be partial, the rest of the key stream is dropped
+    for j := i; j < i + 16 && j < len(text); j++ {
+      res[j] = text[j] ^ keyStream[j - i]
+    }
+    for j := 15; j >= 0; j-- {
+      counter[j]++
+      if counter[j] != 0 {
+        break
+      }
+    }
+  }
+  return res
+}
+
+/*
+Do CFB mode encryption on `text` with the key `encKey` and the `IV`. The key
+stream for each block is the encryption of the previous ciphertext block, the
+IV standing in for the first one.
+*/
+func aes_cfb_enc(text, encKey, IV []byte) []byte {
+  cipher, err := newAES(encKey)
+  check(err)
+  // `feedback` holds the previous ciphertext block
+  feedback := make([]byte, 16)
+  copy(feedback, IV)
+  res := make([]byte, len(text))
+  for i := 0; i < len(text); i += 16 {
+    cipher.Encrypt(feedback, feedback)
+    for j := i; j < i + 16 && j < len(text); j++ {
+      res[j] = text[j] ^ feedback[j - i]
+      feedback[j - i] = res[j]
+    }
+  }
+  return res
+}
+
+/*
+Do CFB mode decryption on `cipherText` with the key `encKey` and the `IV`.
+Note that only AES encryption is ever used, in both directions.
+*/
+func aes_cfb_dec(cipherText, encKey, IV []byte) []byte {
+  cipher, err := newAES(encKey)
+  check(err)
+  feedback := make([]byte, 16)
+  copy(feedback, IV)
+  res := make([]byte, len(cipherText))
+  for i := 0; i < len(cipherText); i += 16 {
+    cipher.Encrypt(feedback, feedback)
+    for j := i; j < i + 16 && j < len(cipherText); j++ {
+      res[j] = cipherText[j] ^ feedback[j - i]
+      feedback[j - i] = cipherText[j]
+    }
+  }
+  return res
+}
+
+/*
+Do OFB mode encryption on `text` with the key `encKey` and the `IV`. The key
+stream is the IV encrypted over and over again, independent of the text, so
+like CTR this is used for decryption as well.
+*/
+func aes_ofb(text, encKey, IV []byte) []byte {
+  cipher, err := newAES(encKey)
+  check(err)
+  keyStream := make([]byte, 16)
+  copy(keyStream, IV)
+  res := make([]byte, len(text))
+  for i := 0; i < len(text); i += 16 {
+    cipher.Encrypt(keyStream, keyStream)
+    for j := i; j < i + 16 && j < len(text); j++ {
+      res[j] = text[j] ^ keyStream[j - i]
+    }
+  }
+  return res
+}
+
 /*
 Strips out PS padding. Easy logic: read the last byte to get the padding length,
 then go on forward to make sure that the length checks out.
@@ -228,7 +1630,7 @@ then go on forward to make sure that the length checks out.
 func stripPadding(text []byte) []byte {
   n := len(text)
   padLen := text[n - 1]
-  if padLen > 16 {
+  if padLen > 16 || padLen == 0 {
     fmt.Println("Invalid Padding in Cipher Text, exiting")
     os.Exit(1)
   }
@@ -0,0 +1,160 @@
+package main
+
+/*
+  A chosen-plaintext oracle: it appends a secret suffix to whatever it is given
+  and encrypts the lot under a built-in key, the way a server might encrypt a
+  cookie holding user input followed by a secret token.
+  USAGE: $ ./encrypt-oracle -i <input file> [-mode ecb|cbc] [-iv random|chained|counter] [-state <file>]
+  The input file is HEX formatted, and so is the ciphertext printed to stdout
+  (IV||ciphertext for cbc). The padding is PKCS #7.
+  With -iv chained or counter, the cbc IV is predictable: the last ciphertext
+  block of the previous message (as in SSL 3.0 and TLS 1.0), or the previous
+  IV plus one. What carries over from one run to the next is kept in the
+  -state file.
+*/
+
+// secret suffix in plain text:
+// The meeting moved to Thursday at noon. Bring the blue folder.
+
+import (
+  "io/ioutil"
+  "fmt"
+  "os"
+  "encoding/hex"
+  "crypto/aes"
+  "crypto/rand"
+  "strings"
+  "flag"
+)
+
+const keyStr string = "940c16dc41f1c4a0ec4dddadb2649325"
+const secretStr string =
+"546865206d656574696e67206d6f76656420746f205468757273646179206174206e6f6f6e2e204272696e672074686520626c756520666f6c6465722e"
+
+//routine for error handling
+func check(e error) {
+  if e != nil {
+    fmt.Println("Error in encrypt-oracle")
+    panic(e)
+  }
+}
+
+func main() {
+  inputFileNameFlag := flag.String("i", "", "input file name")
+  modeFlag := flag.String("mode", "ecb", "block cipher mode of operation: ecb or cbc")
+  ivFlag := flag.String("iv", "random", "how the cbc IV is chosen: random, chained (last ciphertext block of the previous message) or counter (previous IV plus one)")
+  stateFlag := flag.String("state", "iv-state.txt", "file keeping the previous message's IV or last block, for -iv chained and counter")
+  flag.Parse()
+  if *inputFileNameFlag == "" || flag.NArg() != 0 || !(*modeFlag == "ecb" || *modeFlag == "cbc") ||
+    !(*ivFlag == "random" || *ivFlag == "chained" || *ivFlag == "counter") || *ivFlag != "random" && *modeFlag != "cbc" {
+    fmt.Println("usage: ./encrypt-oracle -i <input file name> [-mode ecb|cbc] [-iv random|chained|counter] [-state <file>]\n    -iv only applies to cbc mode")
+    os.Exit(1)
+  }
+  data, err := ioutil.ReadFile(*inputFileNameFlag)
+  check(err)
+  input, err := hex.DecodeString(strings.TrimSpace(string(data)))
+  if err != nil {
+    fmt.Println("Invalid input file: octet representation only.")
+    os.Exit(1)
+  }
+  key, err := hex.DecodeString(keyStr)
+  check(err)
+  secret, err := hex.DecodeString(secretStr)
+  check(err)
+
+  text := psPad(append(input, secret...))
+  var cipherText []byte
+  if *modeFlag == "ecb" {
+    cipherText = aes_ecb_enc(text, key)
+  } else {
+    IV := nextIV(*ivFlag, *stateFlag)
+    res := aes_cbc_enc(text, key, IV)
+    cipherText = append(IV, res...)
+    // remember what the next IV is derived from
+    if *ivFlag == "chained" {
+      err = ioutil.WriteFile(*stateFlag, []byte(hex.EncodeToString(res[len(res) - 16:])), 0644)
+    } else if *ivFlag == "counter" {
+      err = ioutil.WriteFile(*stateFlag, []byte(hex.EncodeToString(IV)), 0644)
+    }
+    check(err)
+  }
+  fmt.Print(hex.EncodeToString(cipherText))
+}
+
+/*
+Function to do the PS padding. Simple logic. Note how you don't really have to
+care whether n equals 0 or not.
+*/
+func psPad(text []byte) []byte {
+  n := len(text) % 16
+  padding := make([]byte, 16 - n)
+  for i := range padding {
+    padding[i] = byte(16 - n)
+  }
+  return append(text, padding...)
+}
+
+/*
+Do ECB mode encryption on `text` with the key `encKey`: every block goes
+through AES on its own, so equal plaintext blocks give equal ciphertext blocks.
+*/
+func aes_ecb_enc(text, encKey []byte) []byte {
+  cipher, err := aes.NewCipher(encKey)
+  check(err)
+  res := make([]byte, len(text))
+  for i := 0; i < len(text); i += 16 {
+    cipher.Encrypt(res[i : i + 16], text[i : i + 16])
+  }
+  return res
+}
+
+/*
+The IV for this message. A random one, unless `ivMode` makes it follow from
+the previous message recorded in `stateFile`: its last ciphertext block for
+chained, its IV plus one (as a 128-bit big-endian integer) for counter. The
+first message, with no state yet, gets a random IV either way.
+*/
+func nextIV(ivMode, stateFile string) []byte {
+  IV := make([]byte, 16)
+  data, err := ioutil.ReadFile(stateFile)
+  if ivMode == "random" || err != nil {
+    _, err = rand.Read(IV)
+    check(err)
+    return IV
+  }
+  _, err = hex.Decode(IV, []byte(strings.TrimSpace(string(data))))
+  check(err)
+  if ivMode == "counter" {
+    for j := 15; j >= 0; j-- {
+      IV[j]++
+      if IV[j] != 0 {
+        break
+      }
+    }
+  }
+  return IV
+}
+
+/*
+Do CBC mode encryption on the input `text`, with the key `encKey` and the `IV`.
+The S-block used is AES. Returns the encrypted text.
+*/
+func aes_cbc_enc(text, encKey, IV []byte) []byte {
+  // `cipherBlock` is a temp value used during calculation
+  cipherBlock := make([]byte, 16)
+  copy(cipherBlock, IV)
+
+  res := make([]byte, len(text))
+  // get the AES cipher
+  cipher, err := aes.NewCipher(encKey)
+  check(err)
+  // block by block calculation
+  for i := 0; i < len(text) / 16; i++ {
+    for j := 0; j < 16; j++ {
+      text[i * 16 + j] ^= cipherBlock[j]
+    }
+    cipher.Encrypt(cipherBlock, text[i * 16 : i * 16 + 16])
+    copy(res[i * 16 : i * 16 + 16], cipherBlock)
+  }
+  return res
+}
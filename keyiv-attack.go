@@ -0,0 +1,230 @@
+package main
+
+import (
+  "io/ioutil"
+  "fmt"
+  "os"
+  "encoding/hex"
+  "crypto/aes"
+  "os/exec"
+  "strings"
+  "flag"
+  "bytes"
+)
+
+/*
+Key recovery against CBC encryption that uses the encryption key as the IV
+(`encrypt-auth -iv-key`), given a decryption oracle that shows the plaintext
+it got whenever the MAC or the parsing fails (`decrypt-test -iv-key -leak`).
+One query is enough: the first ciphertext block C_1 is sent as
+  C_1 || 0 || C_1 || ...
+whose first and third plaintext blocks are
+  P'_1 = aes-dec(C_1) ^ K
+  P'_3 = aes-dec(C_1) ^ 0
+so P'_1 ^ P'_3 is the key K. The original ciphertext follows, which keeps the
+padding at the end valid so that it is the MAC check that fails.
+
+The attack is set as challenge 27 of the Cryptopals crypto challenges.
+*/
+
+// command used to query the decryption oracle, and the extra flags passed to it
+var oracleCmd string
+var oracleArgs []string
+
+// routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  inputFileNameFlag := flag.String ("i", "ciphertext.txt", "input file name")
+  outputFileNameFlag := flag.String ("o", "restored-plaintext.txt", "output file name")
+  oracleFlag := flag.String ("oracle", "./decrypt-test", "oracle program to query")
+  oracleArgsFlag := flag.String ("oracle-args", "-iv-key -leak", `extra flags passed to the oracle program, e.g. "-iv-key -leak -scheme eam"`)
+  flag.Parse()
+  oracleCmd = *oracleFlag
+  oracleArgs = strings.Fields(*oracleArgsFlag)
+
+  data, err := ioutil.ReadFile(*inputFileNameFlag)
+  if err != nil {
+    fmt.Printf ("input file %s does not exit!\n", *inputFileNameFlag)
+    os.Exit(1)
+  }
+  headers, rest := parseHeaders(data)
+  scheme := headers["Scheme"]
+  if scheme == "" {
+    scheme = "mte"
+  }
+  if scheme != "mte" && scheme != "eam" || headers["Mode"] != "" && headers["Mode"] != "cbc" {
+    fmt.Println("Only CBC ciphertexts of the mte and eam schemes can be attacked this way: " +
+      "with etm the MAC is checked before anything is decrypted")
+    os.Exit(1)
+  }
+  cipherText, err := hex.DecodeString(strings.TrimSpace(string(rest)))
+  // for eam, the raw tag follows the CBC blocks
+  tagLen := 0
+  if scheme == "eam" {
+    tagLen = 32
+  }
+  if err != nil || len(cipherText) < tagLen + 16 || (len(cipherText) - tagLen) % 16 != 0 {
+    fmt.Println("Invalid Input File")
+    os.Exit(1)
+  }
+  if headers["IV"] != "key" {
+    fmt.Println("warning: the input file does not record the key as its IV")
+  }
+
+  // C_1 || 0 || C_1 || C
+  query := append([]byte{}, cipherText[:16]...)
+  query = append(query, make([]byte, 16)...)
+  query = append(query, cipherText[:16]...)
+  query = append(query, cipherText...)
+  response := queryOracle(query)
+  leak := leakedPlainText(response)
+  if len(leak) < 48 {
+    fmt.Println("Attack failed: the oracle revealed no plaintext, it said:", response)
+    os.Exit(1)
+  }
+  key := make([]byte, 16)
+  for j := range key {
+    key[j] = leak[j] ^ leak[32 + j]
+  }
+  // an AES-192 or AES-256 key only lends its first 16 bytes to the IV, and
+  // that is all the query gives away
+  if keyLen := headers["Key-Length"]; keyLen != "" && keyLen != "16" {
+    fmt.Printf("recovered IV: %s\n", hex.EncodeToString(key))
+    fmt.Printf("Attack failed: the IV is only the first 16 bytes of a %s-byte Enc_key, the rest of it is unknown\n", keyLen)
+    os.Exit(1)
+  }
+  fmt.Printf("recovered key: %s\n", hex.EncodeToString(key))
+
+  // the key is the IV, so the whole ciphertext can be read now
+  plainText := aes_cbc_dec(cipherText[:len(cipherText) - tagLen], key, key)
+  // a file that does not say how long its key is may still hold a longer one,
+  // which shows up as garbage where the padding should be
+  if (headers["Padding"] == "" || headers["Padding"] == "pkcs7") && !validPKCS7(plainText) {
+    fmt.Printf("Attack failed: the plaintext has no valid padding, so %s is most likely only the first 16 bytes of a longer Enc_key\n", hex.EncodeToString(key))
+    os.Exit(1)
+  }
+  plainText = unpad(plainText, headers["Padding"])
+  if scheme == "mte" {
+    if len(plainText) < 32 {
+      fmt.Println("Attack failed: the plaintext is too short to hold a tag")
+      os.Exit(1)
+    }
+    plainText = plainText[:len(plainText) - 32]
+  }
+  fmt.Printf("recovered %d bytes of plaintext in 1 query\n", len(plainText))
+  outputContent := make([]byte, hex.EncodedLen(len(plainText)))
+  hex.Encode(outputContent, plainText)
+  ioutil.WriteFile(*outputFileNameFlag, outputContent, 0644)
+}
+
+/*
+The plaintext a -leak oracle reports after its error message, hex formatted
+and separated by a space. Returns nil when there is none.
+*/
+func leakedPlainText(response string) []byte {
+  fields := strings.Fields(response)
+  if len(fields) < 2 {
+    return nil
+  }
+  leak, err := hex.DecodeString(fields[len(fields) - 1])
+  if err != nil {
+    return nil
+  }
+  return leak
+}
+
+/*
+Do CBC mode decryption on `cipherText` with the key `encKey` and the `IV`.
+*/
+func aes_cbc_dec(cipherText, encKey, IV []byte) []byte {
+  cipher, err := aes.NewCipher(encKey)
+  check(err)
+  prev := IV
+  res := make([]byte, len(cipherText))
+  for i := 0; i < len(cipherText); i += 16 {
+    cipher.Decrypt(res[i : i + 16], cipherText[i : i + 16])
+    for j := 0; j < 16; j++ {
+      res[i + j] ^= prev[j]
+    }
+    prev = cipherText[i : i + 16]
+  }
+  return res
+}
+
+/*
+Remove the padding, trusting it since the ciphertext came from the real
+sender. pkcs7 and x923 give the padding length in the last byte, iso7816 ends
+the text with 0x80 and zeros.
+*/
+func unpad(text []byte, padding string) []byte {
+  if len(text) == 0 {
+    return text
+  }
+  if padding == "iso7816" {
+    if end := bytes.LastIndexByte(text, 0x80); end >= 0 {
+      return text[:end]
+    }
+    return text
+  }
+  n := int(text[len(text) - 1])
+  if n == 0 || n > 16 || n > len(text) {
+    return text
+  }
+  return text[:len(text) - n]
+}
+
+// whether `text` ends in PKCS #7 padding: n bytes of value n, n from 1 to 16
+func validPKCS7(text []byte) bool {
+  if len(text) == 0 {
+    return false
+  }
+  n := int(text[len(text) - 1])
+  if n == 0 || n > 16 || n > len(text) {
+    return false
+  }
+  for _, b := range text[len(text) - n:] {
+    if int(b) != n {
+      return false
+    }
+  }
+  return true
+}
+
+/*
+Submit `query` to the oracle and return its response message. The query is
+written hex formatted into test.txt, which is handed to the oracle program.
+*/
+func queryOracle(query []byte) string {
+  ioutil.WriteFile("test.txt", []byte(hex.EncodeToString(query)), 0644)
+  args := append([]string{"-i", "test.txt"}, oracleArgs...)
+  out, err := exec.Command(oracleCmd, args...).CombinedOutput()
+  check(err)
+  return string(out)
+}
+
+/*
+Split the "Name: value" header lines that encrypt-auth writes off the front of
+a file. Returns the headers found and the rest of the file.
+*/
+func parseHeaders(data []byte) (map[string]string, []byte) {
+  headers := make(map[string]string)
+  for {
+    end := bytes.IndexByte(data, '\n')
+    if end < 0 {
+      break
+    }
+    line := string(data[:end])
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+      break
+    }
+    headers[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon + 1:])
+    data = data[end + 1:]
+  }
+  return headers, data
+}
@@ -0,0 +1,243 @@
+package main
+
+/*
+  SHA-256 length extension against the naive MAC of encrypt-auth
+  (-mac naive), where the tag is SHA256(Mac_key || message).
+  USAGE: $ go run length-extension.go -i <ciphertext file> -o <output file> [-append <hex>] [-key-len <n>]
+  flags: append : whole 16-byte blocks of ciphertext to add to the message.
+         key-len: the length of Mac_key the attacker assumes, 16 by default.
+  The input is an etm ciphertext, IV||C'||T, whose tag covers IV||C' and is
+  sent in the clear. SHA-256 hands out its whole internal state as the hash,
+  so from T the hashing can be carried on past the SHA-256 padding of
+  Mac_key || IV||C' (the glue) without knowing the key:
+    SHA256(Mac_key || IV||C' || glue || more) = go on from T with `more`
+  Here `more` is the blocks given with -append followed by the last two
+  ciphertext blocks, which decrypt to the original last plaintext block and so
+  keep the padding valid. The output keeps the input's headers, and the
+  receiver accepts it.
+*/
+
+import (
+  "io/ioutil"
+  "fmt"
+  "os"
+  "encoding/hex"
+  "encoding/binary"
+  "math/bits"
+  "strings"
+  "flag"
+  "bytes"
+)
+
+//routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  inputFileNameFlag := flag.String("i", "ciphertext.txt", "input file name")
+  outputFileNameFlag := flag.String("o", "extended-ciphertext.txt", "output file name")
+  appendFlag := flag.String("append", "", "ciphertext blocks to append, in hex, a multiple of 16 bytes")
+  keyLenFlag := flag.Int("key-len", 16, "length of Mac_key in bytes, as far as the attacker can tell")
+  flag.Parse()
+  extra, err := hex.DecodeString(*appendFlag)
+  if flag.NArg() != 0 || err != nil || len(extra) % 16 != 0 || *keyLenFlag < 0 {
+    fmt.Println("-append has to be whole 16-byte blocks in hex, and -key-len cannot be negative")
+    os.Exit(1)
+  }
+
+  data, err := ioutil.ReadFile(*inputFileNameFlag)
+  if err != nil {
+    fmt.Printf("input file %s does not exist!\n", *inputFileNameFlag)
+    os.Exit(1)
+  }
+  headers, rest := parseHeaders(data)
+  headerLines := data[:len(data) - len(rest)]
+  if headers["Scheme"] != "etm" || headers["MAC"] != "naive" || headers["Mode"] != "" && headers["Mode"] != "cbc" {
+    fmt.Println("Only CBC ciphertexts of the etm scheme with the naive MAC can be extended")
+    os.Exit(1)
+  }
+  cipherText, err := hex.DecodeString(strings.TrimSpace(string(rest)))
+  if err != nil || len(cipherText) < 64 || len(cipherText) % 16 != 0 {
+    fmt.Println("Invalid Input File")
+    os.Exit(1)
+  }
+  n := len(cipherText)
+  body, tag := cipherText[:n - 32], cipherText[n - 32:]
+
+  // what the key and body were padded with inside the hash
+  glue := sha256Padding(*keyLenFlag + len(body))
+  more := append(append([]byte{}, extra...), body[len(body) - 32:]...)
+  newTag := extend(tag, *keyLenFlag + len(body) + len(glue), more)
+  forged := append(append(append([]byte{}, body...), glue...), more...)
+  if len(forged) % 16 != 0 {
+    fmt.Println("warning: with this key length the glue does not fill whole blocks, and the receiver will not take the ciphertext")
+  }
+  fmt.Printf("appended %d bytes of glue and %d of ciphertext, new tag %s\n", len(glue), len(more), hex.EncodeToString(newTag))
+
+  outputContent := make([]byte, hex.EncodedLen(len(forged) + 32))
+  hex.Encode(outputContent, append(forged, newTag...))
+  err = ioutil.WriteFile(*outputFileNameFlag, append(headerLines, outputContent...), 0644)
+  check(err)
+}
+
+/*
+The padding SHA-256 puts after a message of `length` bytes: 0x80, zeros up to
+8 bytes short of a multiple of 64, and the length in bits as a 64-bit
+big-endian integer. For a 16-byte key and a block-aligned body the glue is
+whole blocks as well.
+*/
+func sha256Padding(length int) []byte {
+  padLen := 64 - (length + 9) % 64 + 9
+  if padLen > 64 {
+    padLen -= 64
+  }
+  padding := make([]byte, padLen)
+  padding[0] = 0x80
+  binary.BigEndian.PutUint64(padding[padLen - 8:], uint64(length) * 8)
+  return padding
+}
+
+/*
+Carry on a SHA-256 hash whose result was `digest`, after `processed` bytes of
+message and padding, with the bytes of `more`. The digest is the chaining value
+the hash stopped at, so it is loaded back into the state as is, and the padding
+of the final length goes on the end as usual.
+*/
+func extend(digest []byte, processed int, more []byte) []byte {
+  d := &sha256Digest{length: uint64(processed)}
+  for i := range d.h {
+    d.h[i] = binary.BigEndian.Uint32(digest[4 * i:])
+  }
+  d.write(more)
+  return d.sum()
+}
+
+/*
+SHA-256 written out by hand, following FIPS 180-4. The internal state is left
+in the open: `h` is the chaining value after the first `length` bytes written,
+less the ones in `buf`, which are waiting for a whole 64-byte block. Setting
+`h` and `length` to a hash and the length it covered carries that hash on.
+*/
+type sha256Digest struct {
+  h [8]uint32
+  buf []byte
+  length uint64
+}
+
+// initial chaining value: the first 32 bits of the fractional parts of the
+// square roots of the first 8 primes
+var sha256H0 = [8]uint32{
+  0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+// round constants: the first 32 bits of the fractional parts of the cube
+// roots of the first 64 primes
+var sha256K = [64]uint32{
+  0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+  0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+  0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+  0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+  0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+  0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+  0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+  0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+}
+
+func newSHA256() *sha256Digest {
+  return &sha256Digest{h: sha256H0}
+}
+
+// hash `data`, one 64-byte block at a time
+func (d *sha256Digest) write(data []byte) {
+  d.length += uint64(len(data))
+  d.buf = append(d.buf, data...)
+  for len(d.buf) >= 64 {
+    sha256Compress(&d.h, d.buf[:64])
+    d.buf = d.buf[64:]
+  }
+}
+
+/*
+The hash of everything written so far. The message is padded with 0x80, zeros
+up to 8 bytes short of a whole block, and the length in bits as a 64-bit
+big-endian integer. This works on a copy of the state, so more can be written
+afterwards.
+*/
+func (d *sha256Digest) sum() []byte {
+  h := d.h
+  rest := append(append([]byte{}, d.buf...), 0x80)
+  for len(rest) % 64 != 56 {
+    rest = append(rest, 0)
+  }
+  bitLen := make([]byte, 8)
+  binary.BigEndian.PutUint64(bitLen, d.length * 8)
+  rest = append(rest, bitLen...)
+  for i := 0; i < len(rest); i += 64 {
+    sha256Compress(&h, rest[i : i + 64])
+  }
+  res := make([]byte, 32)
+  for i := range h {
+    binary.BigEndian.PutUint32(res[4 * i:], h[i])
+  }
+  return res
+}
+
+/*
+The SHA-256 compression function (FIPS 180-4, section 6.2.2): mix one 64-byte
+block into the chaining value `h`.
+*/
+func sha256Compress(h *[8]uint32, block []byte) {
+  // message schedule
+  var w [64]uint32
+  for t := 0; t < 16; t++ {
+    w[t] = binary.BigEndian.Uint32(block[4 * t:])
+  }
+  for t := 16; t < 64; t++ {
+    s0 := bits.RotateLeft32(w[t - 15], -7) ^ bits.RotateLeft32(w[t - 15], -18) ^ (w[t - 15] >> 3)
+    s1 := bits.RotateLeft32(w[t - 2], -17) ^ bits.RotateLeft32(w[t - 2], -19) ^ (w[t - 2] >> 10)
+    w[t] = w[t - 16] + s0 + w[t - 7] + s1
+  }
+  a, b, c, d, e, f, g, hh := h[0], h[1], h[2], h[3], h[4], h[5], h[6], h[7]
+  for t := 0; t < 64; t++ {
+    S1 := bits.RotateLeft32(e, -6) ^ bits.RotateLeft32(e, -11) ^ bits.RotateLeft32(e, -25)
+    ch := (e & f) ^ (^e & g)
+    t1 := hh + S1 + ch + sha256K[t] + w[t]
+    S0 := bits.RotateLeft32(a, -2) ^ bits.RotateLeft32(a, -13) ^ bits.RotateLeft32(a, -22)
+    maj := (a & b) ^ (a & c) ^ (b & c)
+    t2 := S0 + maj
+    hh, g, f, e, d, c, b, a = g, f, e, d + t1, c, b, a, t1 + t2
+  }
+  h[0] += a
+  h[1] += b
+  h[2] += c
+  h[3] += d
+  h[4] += e
+  h[5] += f
+  h[6] += g
+  h[7] += hh
+}
+
+/*
+Split the "Name: value" header lines that encrypt-auth writes off the front of
+a file. Returns the headers found and the rest of the file.
+*/
+func parseHeaders(data []byte) (map[string]string, []byte) {
+  headers := make(map[string]string)
+  for {
+    end := bytes.IndexByte(data, '\n')
+    if end < 0 {
+      break
+    }
+    line := string(data[:end])
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+      break
+    }
+    headers[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon + 1:])
+    data = data[end + 1:]
+  }
+  return headers, data
+}
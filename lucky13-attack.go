@@ -0,0 +1,217 @@
+package main
+
+import (
+  "io/ioutil"
+  "fmt"
+  "os"
+  "encoding/hex"
+  "crypto/rand"
+  "os/exec"
+  "sort"
+  "strings"
+  "flag"
+  "bytes"
+  "time"
+)
+
+/*
+Lucky Thirteen against `decrypt-test -scheme tls`, which answers every bad
+record with the same "BAD RECORD MAC" but computes the HMAC over fewer bytes
+when the padding is good. The attack sends records of 5 blocks (80 bytes of
+plaintext) whose last block is the target ciphertext block C_i, with an edited
+C_(i-1) in front of it. The HMAC then hashes
+  8 (sequence number) + 80 - 32 (tag) - padding length
+bytes of message, plus the 64-byte ipad block and at least 9 bytes of SHA-256
+padding. With a bad padding that is 129 bytes, three compressions; with any
+good padding at most 128, two. The one compression saved is the only leak, and
+it is found by timing every guess a number of times.
+
+Attack described in:
+N. J. AlFardan and K. G. Paterson, Lucky Thirteen: Breaking the TLS and DTLS
+Record Protocols, IEEE S&P 2013.
+*/
+
+// command used to query the oracle, and the extra flags passed to it
+var oracleCmd string
+var oracleArgs []string
+// how many times the oracle gave each response
+var responses = make(map[string]int)
+// time spent waiting for the oracle, over all queries
+var queryTime time.Duration
+
+// how many of the fastest guesses are timed again, and how many times
+const shortlist int = 8
+var repeat int
+
+// routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  inputFileNameFlag := flag.String ("i", "ciphertext.txt", "input file name")
+  outputFileNameFlag := flag.String ("o", "restored-block.txt", "output file name")
+  oracleFlag := flag.String ("oracle", "./decrypt-test", "oracle program to query")
+  oracleArgsFlag := flag.String ("oracle-args", "-scheme tls -block-delay 2ms", "extra flags passed to the oracle program")
+  blockFlag := flag.Int ("block", 1, "which plaintext block to recover, counting from 1")
+  repeatFlag := flag.Int ("repeat", 5, "how many more times each of the fastest guesses is timed")
+  flag.Parse()
+  oracleCmd = *oracleFlag
+  oracleArgs = strings.Fields(*oracleArgsFlag)
+  repeat = *repeatFlag
+
+  data, err := ioutil.ReadFile(*inputFileNameFlag)
+  if err != nil {
+    fmt.Printf ("input file %s does not exit!\n", *inputFileNameFlag)
+    os.Exit(1)
+  }
+  headers, rest := parseHeaders(data)
+  if headers["Scheme"] != "tls" {
+    fmt.Println("warning: the input file does not record the tls scheme")
+  }
+  cipherTextWithIV, err := hex.DecodeString(strings.TrimSpace(string(rest)))
+  if err != nil || len(cipherTextWithIV) < 32 || len(cipherTextWithIV) % 16 != 0 {
+    fmt.Println("Invalid Input File")
+    os.Exit(1)
+  }
+  i := *blockFlag
+  if i < 1 || 16 * i + 16 > len(cipherTextWithIV) || repeat < 1 {
+    fmt.Printf("-block has to be between 1 and %d, and -repeat at least 1\n", len(cipherTextWithIV) / 16 - 1)
+    os.Exit(1)
+  }
+
+  start := time.Now()
+  plainText := recoverBlock(cipherTextWithIV[16 * i - 16 : 16 * i], cipherTextWithIV[16 * i : 16 * i + 16])
+  if len(responses) != 1 {
+    fmt.Println("warning: the oracle's answers differ, it does not only leak through timing")
+    printResponses()
+  }
+  fmt.Printf("recovered block %d in %d queries, %v\n", i, queryCount(), time.Since(start).Round(time.Millisecond))
+  outputContent := make([]byte, hex.EncodedLen(len(plainText)))
+  hex.Encode(outputContent, plainText)
+  ioutil.WriteFile(*outputFileNameFlag, outputContent, 0644)
+}
+
+/*
+Main function for the attack. The plaintext block behind `target` is
+aes-dec(target) ^ prev. To recover byte 15 - k, the bytes after it are set to
+k by xor-ing `prev`, and each guess g of the byte is tried by xor-ing in g ^ k:
+the padding of k + 1 bytes is good exactly when the guess is right. The bytes
+in front are randomized on every query, so that a longer good padding turning
+up by chance does not fool the timing twice.
+*/
+func recoverBlock(prev, target []byte) []byte {
+  plainText := make([]byte, 16)
+  // three blocks in front of C_(i-1), so that the record is 80 bytes long
+  prefix := make([]byte, 64)
+  _, err := rand.Read(prefix)
+  check(err)
+  for k := 0; k < 16; k++ {
+    pos := 15 - k
+    timings := make([][]time.Duration, 256)
+    query := func(g int) {
+      delta := make([]byte, 16)
+      _, err := rand.Read(delta[:pos])
+      check(err)
+      delta[pos] = byte(g) ^ byte(k)
+      for j := pos + 1; j < 16; j++ {
+        delta[j] = plainText[j] ^ byte(k)
+      }
+      edited := make([]byte, 16)
+      for j := range edited {
+        edited[j] = prev[j] ^ delta[j]
+      }
+      record := append(append(append([]byte{}, prefix...), edited...), target...)
+      timings[g] = append(timings[g], timeQuery(record))
+    }
+    // time every guess once, then the fastest few again
+    for g := 0; g < 256; g++ {
+      query(g)
+    }
+    order := make([]int, 256)
+    for g := range order {
+      order[g] = g
+    }
+    sort.Slice(order, func(a, b int) bool {
+      return timings[order[a]][0] < timings[order[b]][0]
+    })
+    best := -1
+    for _, g := range order[:shortlist] {
+      for r := 0; r < repeat; r++ {
+        query(g)
+      }
+      if best < 0 || median(timings[g]) < median(timings[best]) {
+        best = g
+      }
+    }
+    plainText[pos] = byte(best)
+    fmt.Printf(".")
+  }
+  fmt.Println()
+  return plainText
+}
+
+// the median of `timings`, which is sorted in place
+func median(timings []time.Duration) time.Duration {
+  sort.Slice(timings, func(a, b int) bool {
+    return timings[a] < timings[b]
+  })
+  return timings[len(timings) / 2]
+}
+
+/*
+Submit `query` to the oracle and return how long it took to answer. The query
+is written hex formatted into test.txt, which is handed to the oracle program.
+*/
+func timeQuery(query []byte) time.Duration {
+  ioutil.WriteFile("test.txt", []byte(hex.EncodeToString(query)), 0644)
+  args := append([]string{"-i", "test.txt"}, oracleArgs...)
+  start := time.Now()
+  out, err := exec.Command(oracleCmd, args...).CombinedOutput()
+  elapsed := time.Since(start)
+  queryTime += elapsed
+  check(err)
+  responses[string(out)]++
+  return elapsed
+}
+
+// number of queries made so far
+func queryCount() int {
+  queries := 0
+  for _, count := range responses {
+    queries += count
+  }
+  return queries
+}
+
+// print how often the oracle gave each response
+func printResponses() {
+  fmt.Println("oracle responses:")
+  for response, count := range responses {
+    fmt.Printf("  %-24s %d\n", response, count)
+  }
+}
+
+/*
+Split the "Name: value" header lines that encrypt-auth writes off the front of
+a file. Returns the headers found and the rest of the file.
+*/
+func parseHeaders(data []byte) (map[string]string, []byte) {
+  headers := make(map[string]string)
+  for {
+    end := bytes.IndexByte(data, '\n')
+    if end < 0 {
+      break
+    }
+    line := string(data[:end])
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+      break
+    }
+    headers[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon + 1:])
+    data = data[end + 1:]
+  }
+  return headers, data
+}
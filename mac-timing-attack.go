@@ -0,0 +1,237 @@
+package main
+
+import (
+  "io/ioutil"
+  "fmt"
+  "os"
+  "encoding/hex"
+  "os/exec"
+  "sort"
+  "strings"
+  "flag"
+  "bytes"
+  "time"
+)
+
+/*
+Tag forgery against `decrypt-test -compare early-exit`, which compares the tag
+it received with the right one byte by byte and stops at the first difference.
+The tag of the etm and eam schemes is sent in the clear, so the attacker can
+put any value there: the guess for byte j that takes longest to be rejected is
+the one that made the comparison go on to byte j + 1. Byte after byte, that
+gives a valid HMAC for whatever ciphertext the attacker chose, e.g. one edited
+by cbc-bitflip, without ever knowing `Mac_key`.
+*/
+
+// command used to query the oracle, and the extra flags passed to it
+var oracleCmd string
+var oracleArgs []string
+// how many times the oracle gave each response
+var responses = make(map[string]int)
+
+// how many of the slowest guesses are timed again, and how many times
+const shortlist int = 16
+var repeat int
+// how many times a byte may be searched for again before giving up
+const maxRetries int = 16
+
+// routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  inputFileNameFlag := flag.String ("i", "ciphertext.txt", "input file name")
+  outputFileNameFlag := flag.String ("o", "forged-ciphertext.txt", "output file name")
+  oracleFlag := flag.String ("oracle", "./decrypt-test", "oracle program to query")
+  oracleArgsFlag := flag.String ("oracle-args", "-compare early-exit -byte-delay 2ms", "extra flags passed to the oracle program")
+  repeatFlag := flag.Int ("repeat", 5, "how many more times each of the slowest guesses is timed")
+  flag.Parse()
+  oracleCmd = *oracleFlag
+  oracleArgs = strings.Fields(*oracleArgsFlag)
+  repeat = *repeatFlag
+
+  data, err := ioutil.ReadFile(*inputFileNameFlag)
+  if err != nil {
+    fmt.Printf ("input file %s does not exit!\n", *inputFileNameFlag)
+    os.Exit(1)
+  }
+  headers, rest := parseHeaders(data)
+  headerLines := data[:len(data) - len(rest)]
+  if headers["Scheme"] != "etm" && headers["Scheme"] != "eam" {
+    fmt.Println("Only the etm and eam schemes send the tag in the clear")
+    os.Exit(1)
+  }
+  // the query files carry no headers, so the oracle is told the scheme
+  oracleArgs = append([]string{"-scheme", headers["Scheme"]}, oracleArgs...)
+  cipherText, err := hex.DecodeString(strings.TrimSpace(string(rest)))
+  if err != nil || len(cipherText) < 48 || repeat < 1 {
+    fmt.Println("Invalid Input File")
+    os.Exit(1)
+  }
+
+  start := time.Now()
+  // whatever tag the file came with is thrown away
+  body := cipherText[:len(cipherText) - 32]
+  tag := forgeTag(body)
+  if !strings.Contains(queryOracle(append(body, tag...)), "SUCCESS") {
+    fmt.Println("Attack failed: the forged tag was not accepted")
+    printResponses()
+    os.Exit(1)
+  }
+  fmt.Printf("forged tag %s in %d queries, %v\n", hex.EncodeToString(tag), queryCount(), time.Since(start).Round(time.Millisecond))
+
+  outputContent := make([]byte, hex.EncodedLen(len(body) + 32))
+  hex.Encode(outputContent, append(body, tag...))
+  err = ioutil.WriteFile(*outputFileNameFlag, append(headerLines, outputContent...), 0644)
+  check(err)
+}
+
+/*
+Main function for the attack. For each byte of the tag, every value is timed
+once with the bytes found so far in front of it, then the slowest few are timed
+`repeat` more times and the highest median wins. A guess the oracle accepts
+ends the search right away, which is how the last byte is found.
+With every right byte, all the guesses for the next one take a step longer to
+be rejected. When they do not, the byte before was wrong after all, and it is
+searched for again. The same goes for a winner that is not a step slower than
+the rest, which happens when a few slow runs of the oracle crowd the right
+guess out of the shortlist.
+*/
+func forgeTag(body []byte) []byte {
+  tag := make([]byte, 32)
+  // the median time over all guesses for each byte, and the time one more
+  // byte compared adds, as seen on the first byte
+  levels := make([]time.Duration, 32)
+  var step time.Duration
+  retries := 0
+  for j := 0; j < 32; j++ {
+    if retries > maxRetries {
+      fmt.Println()
+      fmt.Println("Attack failed: no guess stands out, the tag comparison does not seem to leak its timing")
+      printResponses()
+      os.Exit(1)
+    }
+    timings := make([][]time.Duration, 256)
+    accepted := -1
+    query := func(g int) {
+      tag[j] = byte(g)
+      start := time.Now()
+      response := queryOracle(append(body, tag...))
+      timings[g] = append(timings[g], time.Since(start))
+      if strings.Contains(response, "SUCCESS") {
+        accepted = g
+      }
+    }
+    for g := 0; g < 256 && accepted < 0; g++ {
+      query(g)
+    }
+    if accepted >= 0 {
+      tag[j] = byte(accepted)
+      fmt.Printf(".")
+      break
+    }
+    var all []time.Duration
+    for g := range timings {
+      all = append(all, timings[g][0])
+    }
+    levels[j] = median(all)
+    if j > 0 && levels[j] - levels[j - 1] < step / 2 {
+      fmt.Printf("x")
+      retries++
+      j -= 2
+      continue
+    }
+    order := make([]int, 256)
+    for g := range order {
+      order[g] = g
+    }
+    sort.Slice(order, func(a, b int) bool {
+      return timings[order[a]][0] > timings[order[b]][0]
+    })
+    best := -1
+    for _, g := range order[:shortlist] {
+      for r := 0; r < repeat; r++ {
+        query(g)
+      }
+      if best < 0 || median(timings[g]) > median(timings[best]) {
+        best = g
+      }
+    }
+    if j > 0 && median(timings[best]) - levels[j] < step / 2 {
+      fmt.Printf("x")
+      retries++
+      j--
+      continue
+    }
+    tag[j] = byte(best)
+    if j == 0 {
+      step = median(timings[best]) - levels[0]
+    }
+    fmt.Printf(".")
+  }
+  fmt.Println()
+  return tag
+}
+
+// the median of `timings`, which is sorted in place
+func median(timings []time.Duration) time.Duration {
+  sort.Slice(timings, func(a, b int) bool {
+    return timings[a] < timings[b]
+  })
+  return timings[len(timings) / 2]
+}
+
+/*
+Submit `query` to the oracle and return its response message. The query is
+written hex formatted into test.txt, which is handed to the oracle program.
+*/
+func queryOracle(query []byte) string {
+  ioutil.WriteFile("test.txt", []byte(hex.EncodeToString(query)), 0644)
+  args := append([]string{"-i", "test.txt"}, oracleArgs...)
+  out, err := exec.Command(oracleCmd, args...).CombinedOutput()
+  check(err)
+  responses[string(out)]++
+  return string(out)
+}
+
+// number of queries made so far
+func queryCount() int {
+  queries := 0
+  for _, count := range responses {
+    queries += count
+  }
+  return queries
+}
+
+// print how often the oracle gave each response
+func printResponses() {
+  fmt.Println("oracle responses:")
+  for response, count := range responses {
+    fmt.Printf("  %-24s %d\n", response, count)
+  }
+}
+
+/*
+Split the "Name: value" header lines that encrypt-auth writes off the front of
+a file. Returns the headers found and the rest of the file.
+*/
+func parseHeaders(data []byte) (map[string]string, []byte) {
+  headers := make(map[string]string)
+  for {
+    end := bytes.IndexByte(data, '\n')
+    if end < 0 {
+      break
+    }
+    line := string(data[:end])
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+      break
+    }
+    headers[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon + 1:])
+    data = data[end + 1:]
+  }
+  return headers, data
+}
@@ -0,0 +1,251 @@
+package main
+
+/*
+  Demonstration of bit-flipping on the block cipher modes used without a MAC.
+  USAGE: $ go run malleability-demo.go [flags]
+  flags: text: the message that gets encrypted.
+         from: a piece of the message the attacker knows.
+         to  : what the attacker wants that piece to read, same length as `from`.
+  A random key is drawn on every run. For each mode the message is encrypted,
+  the ciphertext is edited without any knowledge of the key, and the decryption
+  of the edited ciphertext is printed.
+*/
+
+import (
+  "fmt"
+  "os"
+  "strings"
+  "crypto/rand"
+  "crypto/aes"
+  "flag"
+)
+
+//routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  textFlag := flag.String("text", "From: alice; To: mallory; Amount: 0001 USD; Memo: lunch", "the message to encrypt")
+  fromFlag := flag.String("from", "0001", "a piece of the message known to the attacker")
+  toFlag := flag.String("to", "9999", "what the attacker wants the piece to read instead")
+  flag.Parse()
+  text, from, to := []byte(*textFlag), []byte(*fromFlag), []byte(*toFlag)
+  offset := strings.Index(*textFlag, *fromFlag)
+  if offset < 0 || len(from) != len(to) || len(from) == 0 {
+    fmt.Println("`from` has to appear in `text`, and `to` has to be of the same length")
+    os.Exit(1)
+  }
+  key := make([]byte, 16)
+  _, err := rand.Read(key)
+  check(err)
+  fmt.Printf("original:    %q\n", text)
+
+  // CTR and OFB: the key stream does not depend on the text, so flipping a
+  // ciphertext bit flips exactly the same plaintext bit and nothing else
+  for _, mode := range []string{"ctr", "ofb"} {
+    IV := randomIV()
+    var cipherText []byte
+    if mode == "ctr" {
+      cipherText = aes_ctr(text, key, IV)
+    } else {
+      cipherText = aes_ofb(text, key, IV)
+    }
+    flip(cipherText[offset:], from, to)
+    var res []byte
+    if mode == "ctr" {
+      res = aes_ctr(cipherText, key, IV)
+    } else {
+      res = aes_ofb(cipherText, key, IV)
+    }
+    fmt.Printf("%-12s %q\n", mode + ":", res)
+  }
+
+  // CFB: the flipped ciphertext bits go straight into the plaintext, but the
+  // ciphertext block is also fed into the next block's key stream, which
+  // garbles the block that follows
+  IV := randomIV()
+  cipherText := aes_cfb_enc(text, key, IV)
+  flip(cipherText[offset:], from, to)
+  fmt.Printf("%-12s %q\n", "cfb:", aes_cfb_dec(cipherText, key, IV))
+
+  // CBC: the edit has to go into the previous ciphertext block (or the IV),
+  // which is xor-ed into this block after decryption. The previous block
+  // itself decrypts to garbage, unless it is the IV
+  if offset / 16 != (offset + len(from) - 1) / 16 {
+    fmt.Println("cbc:         skipped, the piece has to sit within one block")
+    return
+  }
+  IV, cipherText = aes_cbc_enc(psPad(text), key)
+  cipherTextWithIV := append(IV, cipherText...)
+  flip(cipherTextWithIV[offset:], from, to)
+  res := aes_cbc_dec(cipherTextWithIV[16:], key, cipherTextWithIV[:16])
+  fmt.Printf("%-12s %q\n", "cbc:", res[:len(res) - int(res[len(res) - 1])])
+}
+
+/*
+The edit itself: xor-ing `from` ^ `to` into the ciphertext bytes that end up
+xor-ed with the known piece of plaintext turns it into `to`.
+*/
+func flip(cipherText, from, to []byte) {
+  for i := range from {
+    cipherText[i] ^= from[i] ^ to[i]
+  }
+}
+
+// returns a fresh random IV
+func randomIV() []byte {
+  IV := make([]byte, 16)
+  _, err := rand.Read(IV)
+  check(err)
+  return IV
+}
+
+/*
+Function to do the PS padding. Simple logic. Note how you don't really have to
+care whether n equals 0 or not.
+*/
+func psPad(text []byte) []byte {
+  n := len(text) % 16
+  padding := make([]byte, 16 - n)
+  for i := range padding {
+    padding[i] = byte(16 - n)
+  }
+  return append(text, padding...)
+}
+
+/*
+Do CBC mode encryption on the input `text`, with the key `encKey`. The S-block
+used is AES. Returns the encrypted text as well as IV.
+*/
+func aes_cbc_enc(text, encKey []byte) ([]byte, []byte) {
+  // Get a random IV
+  cipherBlock := make([]byte, 16)
+  _, err := rand.Read(cipherBlock)
+  check(err)
+  // `cipherBlock` is a temp value used during calculation. `IV` is used to
+  // store the initial seed
+  IV := make([]byte, 16)
+  copy(IV, cipherBlock)
+
+  res := make([]byte, len(text))
+  // get the AES cipher
+  cipher, err := aes.NewCipher(encKey)
+  check(err)
+  // block by block calculation
+  for i := 0; i < len(text) / 16; i++ {
+    for j := 0; j < 16; j++ {
+      text[i * 16 + j] ^= cipherBlock[j]
+    }
+    cipher.Encrypt(cipherBlock, text[i * 16 : i * 16 + 16])
+    copy(res[i * 16 : i * 16 + 16], cipherBlock)
+  }
+  return IV, res
+}
+
+/*
+Do CBC mode decryption on the input `cipherText`, with the key `encKey` and the
+`IV`. Returns the decrypted original message. AES is used as the basic block.
+*/
+func aes_cbc_dec(cipherText, encKey, IV []byte) []byte {
+  // intermediate variable used during calculation.
+  plainBlock := make([]byte, len(IV))
+  cipher, err := aes.NewCipher(encKey)
+  check(err)
+  for i := 0; i < len(cipherText) / 16; i++ {
+    copy(plainBlock, cipherText[i * 16 : i * 16 + 16])
+    cipher.Decrypt(cipherText[i * 16 : i * 16 + 16], cipherText[i * 16 : i * 16 + 16])
+    for j := 0; j < 16; j++ {
+      cipherText[i * 16 + j] ^= IV[j]
+    }
+    copy(IV, plainBlock)
+  }
+  return cipherText
+}
+
+/*
+Do CTR mode encryption on `text` with the key `encKey`. The IV is the first
+counter block, and the counter is incremented as a 128-bit big-endian integer
+for every following block. Encryption and decryption are the same operation.
+*/
+func aes_ctr(text, encKey, IV []byte) []byte {
+  cipher, err := aes.NewCipher(encKey)
+  check(err)
+  counter := make([]byte, 16)
+  copy(counter, IV)
+  keyStream := make([]byte, 16)
+  res := make([]byte, len(text))
+  for i := 0; i < len(text); i += 16 {
+    cipher.Encrypt(keyStream, counter)
+    for j := i; j < i + 16 && j < len(text); j++ {
+      res[j] = text[j] ^ keyStream[j - i]
+    }
+    for j := 15; j >= 0; j-- {
+      counter[j]++
+      if counter[j] != 0 {
+        break
+      }
+    }
+  }
+  return res
+}
+
+/*
+Do CFB mode encryption on `text` with the key `encKey` and the `IV`. The key
+stream for each block is the encryption of the previous ciphertext block.
+*/
+func aes_cfb_enc(text, encKey, IV []byte) []byte {
+  cipher, err := aes.NewCipher(encKey)
+  check(err)
+  feedback := make([]byte, 16)
+  copy(feedback, IV)
+  res := make([]byte, len(text))
+  for i := 0; i < len(text); i += 16 {
+    cipher.Encrypt(feedback, feedback)
+    for j := i; j < i + 16 && j < len(text); j++ {
+      res[j] = text[j] ^ feedback[j - i]
+      feedback[j - i] = res[j]
+    }
+  }
+  return res
+}
+
+/*
+Do CFB mode decryption on `cipherText` with the key `encKey` and the `IV`.
+*/
+func aes_cfb_dec(cipherText, encKey, IV []byte) []byte {
+  cipher, err := aes.NewCipher(encKey)
+  check(err)
+  feedback := make([]byte, 16)
+  copy(feedback, IV)
+  res := make([]byte, len(cipherText))
+  for i := 0; i < len(cipherText); i += 16 {
+    cipher.Encrypt(feedback, feedback)
+    for j := i; j < i + 16 && j < len(cipherText); j++ {
+      res[j] = cipherText[j] ^ feedback[j - i]
+      feedback[j - i] = cipherText[j]
+    }
+  }
+  return res
+}
+
+/*
+Do OFB mode encryption on `text` with the key `encKey` and the `IV`. The key
+stream is the IV encrypted over and over again, so this also decrypts.
+*/
+func aes_ofb(text, encKey, IV []byte) []byte {
+  cipher, err := aes.NewCipher(encKey)
+  check(err)
+  keyStream := make([]byte, 16)
+  copy(keyStream, IV)
+  res := make([]byte, len(text))
+  for i := 0; i < len(text); i += 16 {
+    cipher.Encrypt(keyStream, keyStream)
+    for j := i; j < i + 16 && j < len(text); j++ {
+      res[j] = text[j] ^ keyStream[j - i]
+    }
+  }
+  return res
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+  "io/ioutil"
+  "fmt"
+  "os"
+  "encoding/hex"
+  "crypto/sha256"
+  "math/big"
+  "os/exec"
+  "strings"
+  "flag"
+  "bytes"
+  "time"
+)
+
+/*
+Manger's attack on RSA-OAEP, run against `rsa-oracle -scheme oaep`. OAEP is
+meant to fix PKCS #1 v1.5, but an implementation that tells a non-zero first
+byte apart from the other padding failures gives away whether the plaintext is
+below B = 2^(8(k - 1)), and that pins the plaintext down in about 8k queries.
+The ciphertext file is HEX formatted; the public key is asked from the oracle
+program with -pubkey.
+
+Algorithm from:
+J. Manger, A Chosen Ciphertext Attack on RSA Optimal Asymmetric Encryption
+Padding (OAEP) as Standardized in PKCS #1 v2.0, CRYPTO 2001.
+*/
+
+// command used to query the oracle, and the extra flags passed to it
+var oracleCmd string
+var oracleArgs []string
+// how many times the oracle gave each response
+var responses = make(map[string]int)
+// time spent waiting for the oracle, over all queries
+var queryTime time.Duration
+// the public key, and the length of the modulus in bytes
+var n, e *big.Int
+var k int
+
+// routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  inputFileNameFlag := flag.String ("i", "ciphertext.txt", "input file name")
+  outputFileNameFlag := flag.String ("o", "restored-plaintext.txt", "output file name")
+  oracleFlag := flag.String ("oracle", "./rsa-oracle", "oracle program to query")
+  oracleArgsFlag := flag.String ("oracle-args", "-scheme oaep", "extra flags passed to the oracle program")
+  flag.Parse()
+  oracleCmd = *oracleFlag
+  oracleArgs = strings.Fields(*oracleArgsFlag)
+
+  data, err := ioutil.ReadFile(*inputFileNameFlag)
+  if err != nil {
+    fmt.Printf ("input file %s does not exit!\n", *inputFileNameFlag)
+    os.Exit(1)
+  }
+  cipherText, err := hex.DecodeString(strings.TrimSpace(string(data)))
+  if err != nil {
+    fmt.Println("Invalid Input File")
+    os.Exit(1)
+  }
+  readPublicKey()
+  c := new(big.Int).SetBytes(cipherText)
+  if len(cipherText) != k || c.Cmp(n) >= 0 {
+    fmt.Println("Invalid Input File")
+    os.Exit(1)
+  }
+  // the ciphertext itself has to decrypt to a first byte of 0x00
+  if !belowB(c, big.NewInt(1)) {
+    fmt.Println("oracle does not accept the leading byte of the ciphertext itself")
+    printResponses()
+    os.Exit(1)
+  }
+
+  start := time.Now()
+  m := attack(c)
+  fmt.Println()
+  res, ok := oaepDecode(m.FillBytes(make([]byte, k)))
+  if !ok {
+    fmt.Println("Attack failed: recovered plaintext has no valid OAEP padding")
+    printResponses()
+    os.Exit(1)
+  }
+  fmt.Printf("recovered %d bytes in %d queries, %v\n", len(res), queryCount(), time.Since(start).Round(time.Millisecond))
+
+  outputContent := make([]byte, hex.EncodedLen(len(res)))
+  hex.Encode(outputContent, res)
+  ioutil.WriteFile(*outputFileNameFlag, outputContent, 0644)
+}
+
+/*
+Main function for the attack. The oracle answers whether f * m mod n < B for
+any multiplier f of our choice, since c * f^e decrypts to f * m.
+  Step 1: double f1 until f1 * m reaches B, so that f1 / 2 * m is in [B/2, B).
+  Step 2: step f2 up by f1 / 2 from just above n / B until f2 * m wraps around
+          n back below B, which puts m in [n / f2, (n + B) / f2).
+  Step 3: pick f3 so that f3 * m lands close to a multiple of n plus B, and
+          halve the interval with each answer.
+*/
+func attack(c *big.Int) *big.Int {
+  B := new(big.Int).Lsh(big.NewInt(1), uint(8 * (k - 1)))
+  if new(big.Int).Lsh(B, 1).Cmp(n) >= 0 {
+    fmt.Println("Attack needs 2B < n")
+    os.Exit(1)
+  }
+
+  f1 := big.NewInt(2)
+  for belowB(c, f1) {
+    f1.Lsh(f1, 1)
+    // m is at least 1, so B * m can't be below B: the oracle does not leak
+    if f1.Cmp(B) > 0 {
+      fmt.Println("Attack failed: the oracle never complained about the leading byte")
+      printResponses()
+      os.Exit(1)
+    }
+  }
+  half := new(big.Int).Rsh(f1, 1)
+
+  f2 := new(big.Int).Add(n, B)
+  f2.Div(f2, B)
+  f2.Mul(f2, half)
+  for !belowB(c, f2) {
+    f2.Add(f2, half)
+  }
+
+  mMin := ceilDiv(n, f2)
+  mMax := new(big.Int).Add(n, B)
+  mMax.Div(mMax, f2)
+  // bytes of the plaintext pinned down so far, one dot each
+  known := 0
+  for mMin.Cmp(mMax) < 0 {
+    width := new(big.Int).Sub(mMax, mMin)
+    for ; known < k - (width.BitLen() + 7) / 8; known++ {
+      fmt.Printf(".")
+    }
+    fTmp := new(big.Int).Lsh(B, 1)
+    fTmp.Div(fTmp, width)
+    i := new(big.Int).Mul(fTmp, mMin)
+    i.Div(i, n)
+    in := new(big.Int).Mul(i, n)
+    f3 := ceilDiv(in, mMin)
+    in.Add(in, B)
+    if belowB(c, f3) {
+      mMax = in.Div(in, f3)
+    } else {
+      mMin = ceilDiv(in, f3)
+    }
+  }
+  return mMin
+}
+
+/*
+Undo the OAEP encoding of `EM` (see rsa-oracle). No key is needed for this:
+the masks come from the hash of the other half. Returns false if the padding
+does not check out.
+*/
+func oaepDecode(EM []byte) ([]byte, bool) {
+  hLen := sha256.Size
+  if EM[0] != 0x00 {
+    return nil, false
+  }
+  seed, DB := EM[1 : 1 + hLen], EM[1 + hLen:]
+  xorInto(seed, mgf1(DB, hLen))
+  xorInto(DB, mgf1(seed, len(DB)))
+  lHash := sha256.Sum256(nil)
+  if !bytes.Equal(DB[:hLen], lHash[:]) {
+    return nil, false
+  }
+  sep := hLen
+  for sep < len(DB) && DB[sep] == 0 {
+    sep++
+  }
+  if sep == len(DB) || DB[sep] != 0x01 {
+    return nil, false
+  }
+  return DB[sep + 1:], true
+}
+
+/*
+MGF1 with SHA-256: the hashes of `seed` || counter for counter = 0, 1, ...,
+concatenated and cut to `length` bytes.
+*/
+func mgf1(seed []byte, length int) []byte {
+  var res []byte
+  counter := make([]byte, 4)
+  for i := 0; len(res) < length; i++ {
+    counter[0], counter[1], counter[2], counter[3] = byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)
+    h := sha256.Sum256(append(seed[:len(seed):len(seed)], counter...))
+    res = append(res, h[:]...)
+  }
+  return res[:length]
+}
+
+// dst ^= mask, byte by byte
+func xorInto(dst, mask []byte) {
+  for i := range dst {
+    dst[i] ^= mask[i]
+  }
+}
+
+/*
+Whether c * f^e decrypts to something below B, i.e. the oracle does not
+complain about the leading byte.
+*/
+func belowB(c, f *big.Int) bool {
+  query := new(big.Int).Exp(f, e, n)
+  query.Mul(query, c)
+  query.Mod(query, n)
+  return !strings.Contains(queryOracle(query.FillBytes(make([]byte, k))), "INVALID LEADING BYTE")
+}
+
+// ceil(x / y) for y > 0. big.Int's Div rounds down for a positive divisor
+func ceilDiv(x, y *big.Int) *big.Int {
+  res := new(big.Int).Add(x, y)
+  res.Sub(res, big.NewInt(1))
+  return res.Div(res, y)
+}
+
+/*
+Ask the oracle program for its public key, printed as "n: <hex>" and "e: <hex>"
+lines.
+*/
+func readPublicKey() {
+  args := append([]string{"-pubkey"}, oracleArgs...)
+  out, err := exec.Command(oracleCmd, args...).CombinedOutput()
+  check(err)
+  headers, _ := parseHeaders(out)
+  var ok1, ok2 bool
+  n, ok1 = new(big.Int).SetString(headers["n"], 16)
+  e, ok2 = new(big.Int).SetString(headers["e"], 16)
+  if !ok1 || !ok2 {
+    fmt.Println("oracle gave no public key")
+    os.Exit(1)
+  }
+  k = (n.BitLen() + 7) / 8
+}
+
+/*
+Submit `query` to the oracle and return its response message. The query is
+written hex formatted into test.txt, which is handed to the oracle program.
+*/
+func queryOracle(query []byte) string {
+  outputToFile := make([]byte, hex.EncodedLen(len(query)))
+  hex.Encode(outputToFile, query)
+  ioutil.WriteFile("test.txt", outputToFile, 0644)
+
+  args := append([]string{"-i", "test.txt"}, oracleArgs...)
+  start := time.Now()
+  out, err := exec.Command(oracleCmd, args...).CombinedOutput()
+  queryTime += time.Since(start)
+  check(err)
+  responses[string(out)]++
+  return string(out)
+}
+
+// number of queries made so far
+func queryCount() int {
+  queries := 0
+  for _, count := range responses {
+    queries += count
+  }
+  return queries
+}
+
+// print how often the oracle gave each response
+func printResponses() {
+  fmt.Println("oracle responses:")
+  for response, count := range responses {
+    fmt.Printf("  %-24s %d\n", response, count)
+  }
+}
+
+/*
+Split the "Name: value" header lines off the front of `data`. Returns the
+headers found and the rest.
+*/
+func parseHeaders(data []byte) (map[string]string, []byte) {
+  headers := make(map[string]string)
+  for {
+    end := bytes.IndexByte(data, '\n')
+    if end < 0 {
+      break
+    }
+    line := string(data[:end])
+    colon := strings.Index(line, ":")
+    if colon < 0 {
+      break
+    }
+    headers[strings.TrimSpace(line[:colon])] = strings.TrimSpace(line[colon + 1:])
+    data = data[end + 1:]
+  }
+  return headers, data
+}
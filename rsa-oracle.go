@@ -0,0 +1,278 @@
+package main
+
+/*
+  RSA counterpart of `decrypt-test`: an oracle that decrypts RSA PKCS #1 v1.5
+  or OAEP ciphertexts with a built-in 1024-bit key and tells whether the
+  padding was conforming.
+  USAGE: $ ./rsa-oracle -i <ciphertext file> [-scheme pkcs1|oaep] [-check strict|prefix]
+         $ ./rsa-oracle -encrypt -i <plaintext file> -o <ciphertext file> [-scheme pkcs1|oaep]
+         $ ./rsa-oracle -pubkey
+  Ciphertext and plaintext files are HEX formatted, like everywhere else in the
+  demo. -pubkey prints the public key as "n: <hex>" and "e: <hex>" lines.
+*/
+
+import (
+  "io/ioutil"
+  "fmt"
+  "os"
+  "encoding/hex"
+  "crypto/rand"
+  "crypto/sha256"
+  "bytes"
+  "math/big"
+  "strings"
+  "flag"
+)
+
+// the key pair, in hex. Anyone may know n and e; d is what the oracle guards
+const nStr string =
+"d197c79a717358084e65f7e36d89178b6817f6ea78079b127d1fec1406bd00c200e43006cb4fe871be633efd4aa7cee175b17c2672990570132ee63415891ad4b7a40bd16e0e603bd4a115d23ec1ca3616a9ab026bdcbccd59f46c472329c0c0086a0c9c51766811fcfdaad1117f3c7b6751ef489770e52483724c3d72654e79"
+const eStr string = "10001"
+const dStr string =
+"1ff48c3237e9e61a1e19ddd986f1c7ed3149b613b9892f537a504ba62200df04b52e154473eb12fd84918d210128e499eb5fcc15f092f4094a637425acc2e29c155fac6b6d4ff57953afd5a3a3a1ef667c8c32fbb9d6eca7a74246618cb93dbc5d343e418c23ea2d191c199788c54cfcc61c5694236cad003abcc074ec546ba1"
+
+//routine for error handling
+func check(e error) {
+  if e != nil {
+    fmt.Println("Error in rsa-oracle")
+    panic(e)
+  }
+}
+
+type MyError string
+
+func (e MyError) Error() string {
+  return string(e)
+}
+
+func main() {
+  inputFileNameFlag := flag.String("i", "", "input file name")
+  outputFileNameFlag := flag.String("o", "", "output file name, -encrypt only")
+  encryptFlag := flag.Bool("encrypt", false, "encrypt the input file instead of checking it")
+  pubkeyFlag := flag.Bool("pubkey", false, "print the public key and exit")
+  schemeFlag := flag.String("scheme", "pkcs1", "padding scheme: pkcs1 (PKCS #1 v1.5) or oaep (OAEP with SHA-256)")
+  checkFlag := flag.String("check", "strict", `how pkcs1 padding is checked: strict (0x00 0x02, at least 8 non-zero padding bytes and a 0x00 separator) or prefix (0x00 0x02 only)`)
+  flag.Parse()
+  if flag.NArg() != 0 || !(*checkFlag == "strict" || *checkFlag == "prefix") || !(*schemeFlag == "pkcs1" || *schemeFlag == "oaep") ||
+    (*checkFlag != "strict" && *schemeFlag != "pkcs1") {
+    usage()
+  }
+  n, e, d := parseKey()
+  if *pubkeyFlag {
+    fmt.Printf("n: %x\ne: %x\n", n, e)
+    return
+  }
+  if *inputFileNameFlag == "" || *encryptFlag && *outputFileNameFlag == "" {
+    usage()
+  }
+  input := readHex(*inputFileNameFlag)
+  if *encryptFlag {
+    var cipherText []byte
+    var err error
+    if *schemeFlag == "oaep" {
+      cipherText, err = encryptOAEP(input, n, e)
+    } else {
+      cipherText, err = encrypt(input, n, e)
+    }
+    if err != nil {
+      fmt.Println(err.Error())
+      os.Exit(1)
+    }
+    outputContent := make([]byte, hex.EncodedLen(len(cipherText)))
+    hex.Encode(outputContent, cipherText)
+    err = ioutil.WriteFile(*outputFileNameFlag, outputContent, 0644)
+    check(err)
+    return
+  }
+  var err error
+  if *schemeFlag == "oaep" {
+    _, err = decryptOAEP(input, n, d)
+  } else {
+    _, err = decrypt(input, n, d, *checkFlag)
+  }
+  if err == nil {
+    fmt.Print("SUCCESS")
+  } else {
+    fmt.Print(err.Error())
+  }
+}
+
+func usage() {
+  fmt.Println(
+    `usage: ./rsa-oracle -i <ciphertext file> [-scheme pkcs1|oaep] [-check strict|prefix]
+       ./rsa-oracle -encrypt -i <plaintext file> -o <ciphertext file> [-scheme pkcs1|oaep]
+       ./rsa-oracle -pubkey
+    -check only applies to the pkcs1 scheme`)
+  os.Exit(1)
+}
+
+// decode the built-in key
+func parseKey() (*big.Int, *big.Int, *big.Int) {
+  n, ok1 := new(big.Int).SetString(nStr, 16)
+  e, ok2 := new(big.Int).SetString(eStr, 16)
+  d, ok3 := new(big.Int).SetString(dStr, 16)
+  if !ok1 || !ok2 || !ok3 {
+    check(MyError("bad key"))
+  }
+  return n, e, d
+}
+
+/*
+Encrypt `text` with PKCS #1 v1.5 type 2 padding:
+  EM = 0x00 || 0x02 || PS || 0x00 || M
+where PS is at least 8 random non-zero bytes, filling EM up to the length k of
+the modulus. Returns EM^e mod n as k bytes.
+*/
+func encrypt(text []byte, n, e *big.Int) ([]byte, error) {
+  k := (n.BitLen() + 7) / 8
+  if len(text) > k - 11 {
+    return nil, MyError("MESSAGE TOO LONG")
+  }
+  EM := make([]byte, k)
+  EM[1] = 0x02
+  PS := EM[2 : k - len(text) - 1]
+  for i := range PS {
+    // draw until non-zero, a zero byte would end the padding early
+    for PS[i] == 0 {
+      _, err := rand.Read(PS[i : i + 1])
+      check(err)
+    }
+  }
+  copy(EM[k - len(text):], text)
+  c := new(big.Int).Exp(new(big.Int).SetBytes(EM), e, n)
+  return c.FillBytes(make([]byte, k)), nil
+}
+
+/*
+Decrypt `cipherText` and strip the PKCS #1 v1.5 padding, checked the way
+`paddingCheck` says. The distinct "INVALID PADDING" is the leak: it tells the
+attacker whether cipherText^d mod n starts with 0x00 0x02, which is all
+Bleichenbacher's attack needs.
+*/
+func decrypt(cipherText []byte, n, d *big.Int, paddingCheck string) ([]byte, error) {
+  k := (n.BitLen() + 7) / 8
+  c := new(big.Int).SetBytes(cipherText)
+  if len(cipherText) != k || c.Cmp(n) >= 0 {
+    return nil, MyError("INVALID LENGTH")
+  }
+  EM := new(big.Int).Exp(c, d, n).FillBytes(make([]byte, k))
+  if EM[0] != 0x00 || EM[1] != 0x02 {
+    return nil, MyError("INVALID PADDING")
+  }
+  sep := 2
+  for sep < k && EM[sep] != 0 {
+    sep++
+  }
+  // the prefix check accepts whatever follows 0x00 0x02, even without a
+  // separator
+  if paddingCheck == "strict" && (sep == k || sep < 10) {
+    return nil, MyError("INVALID PADDING")
+  }
+  if sep == k {
+    return nil, nil
+  }
+  return EM[sep + 1:], nil
+}
+
+/*
+Encrypt `text` with OAEP (RFC 8017), using SHA-256 for both the label hash and
+MGF1, and an empty label:
+  DB = lHash || PS || 0x01 || M, PS being zeros
+  EM = 0x00 || (seed ^ MGF(maskedDB)) || (DB ^ MGF(seed))
+with a random 32-byte seed. Returns EM^e mod n as k bytes.
+*/
+func encryptOAEP(text []byte, n, e *big.Int) ([]byte, error) {
+  k := (n.BitLen() + 7) / 8
+  hLen := sha256.Size
+  if len(text) > k - 2 * hLen - 2 {
+    return nil, MyError("MESSAGE TOO LONG")
+  }
+  lHash := sha256.Sum256(nil)
+  EM := make([]byte, k)
+  seed, DB := EM[1 : 1 + hLen], EM[1 + hLen:]
+  copy(DB, lHash[:])
+  DB[len(DB) - len(text) - 1] = 0x01
+  copy(DB[len(DB) - len(text):], text)
+  _, err := rand.Read(seed)
+  check(err)
+  xorInto(DB, mgf1(seed, len(DB)))
+  xorInto(seed, mgf1(DB, hLen))
+  c := new(big.Int).Exp(new(big.Int).SetBytes(EM), e, n)
+  return c.FillBytes(make([]byte, k)), nil
+}
+
+/*
+Decrypt an OAEP `cipherText` and strip the padding. RFC 8017 warns that the
+failures must not be told apart, and this oracle does just that: a first byte
+other than 0x00 is reported as "INVALID LEADING BYTE", anything wrong further
+on as "INVALID PADDING". That is the leak Manger's attack needs: it tells
+whether cipherText^d mod n is below 2^(8(k - 1)).
+*/
+func decryptOAEP(cipherText []byte, n, d *big.Int) ([]byte, error) {
+  k := (n.BitLen() + 7) / 8
+  hLen := sha256.Size
+  c := new(big.Int).SetBytes(cipherText)
+  if len(cipherText) != k || c.Cmp(n) >= 0 {
+    return nil, MyError("INVALID LENGTH")
+  }
+  EM := new(big.Int).Exp(c, d, n).FillBytes(make([]byte, k))
+  if EM[0] != 0x00 {
+    return nil, MyError("INVALID LEADING BYTE")
+  }
+  seed, DB := EM[1 : 1 + hLen], EM[1 + hLen:]
+  xorInto(seed, mgf1(DB, hLen))
+  xorInto(DB, mgf1(seed, len(DB)))
+  lHash := sha256.Sum256(nil)
+  if !bytes.Equal(DB[:hLen], lHash[:]) {
+    return nil, MyError("INVALID PADDING")
+  }
+  // PS is zeros up to the 0x01 separator
+  sep := hLen
+  for sep < len(DB) && DB[sep] == 0 {
+    sep++
+  }
+  if sep == len(DB) || DB[sep] != 0x01 {
+    return nil, MyError("INVALID PADDING")
+  }
+  return DB[sep + 1:], nil
+}
+
+/*
+MGF1 with SHA-256: the hashes of `seed` || counter for counter = 0, 1, ...,
+concatenated and cut to `length` bytes.
+*/
+func mgf1(seed []byte, length int) []byte {
+  var res []byte
+  counter := make([]byte, 4)
+  for i := 0; len(res) < length; i++ {
+    counter[0], counter[1], counter[2], counter[3] = byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)
+    h := sha256.Sum256(append(seed[:len(seed):len(seed)], counter...))
+    res = append(res, h[:]...)
+  }
+  return res[:length]
+}
+
+// dst ^= mask, byte by byte
+func xorInto(dst, mask []byte) {
+  for i := range dst {
+    dst[i] ^= mask[i]
+  }
+}
+
+/*
+Read a HEX formatted file. Whitespace around the content is tolerated; a file
+that is not HEX is a usage error.
+*/
+func readHex(file string) []byte {
+  data, err := ioutil.ReadFile(file)
+  if err != nil {
+    fmt.Printf("input file %s does not exist!\n", file)
+    os.Exit(1)
+  }
+  res, err := hex.DecodeString(strings.TrimSpace(string(data)))
+  if err != nil {
+    fmt.Println("Invalid input file: octet representation only.")
+    os.Exit(1)
+  }
+  return res
+}
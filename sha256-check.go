@@ -0,0 +1,335 @@
+package main
+
+/*
+  Check the hand-written SHA-256 of encrypt-auth and decrypt-test (-sha256
+  scratch) against the test vectors of NIST, and against Go's crypto/sha256 on
+  random messages written in random pieces.
+  USAGE: $ go run sha256-check.go [-n <number of random messages>] [-trace <text>] [-src <directory>]
+  flags: n    : how many random messages to compare, 1000 by default.
+         trace: print the chaining value after every block of hashing `text`,
+                padding included, instead of checking anything.
+         src  : directory holding encrypt-auth.go, decrypt-test.go and
+                sha256-check.go, "." by default.
+  The implementation here is a copy of the one in those programs. The copy is
+  compared with both of them first, and any difference fails the check.
+*/
+
+import (
+  "fmt"
+  "os"
+  "encoding/hex"
+  "encoding/binary"
+  "crypto/sha256"
+  "crypto/rand"
+  "math/big"
+  "math/bits"
+  "strings"
+  "io/ioutil"
+  "path/filepath"
+  "go/ast"
+  "go/parser"
+  "go/token"
+  "flag"
+)
+
+// the declarations copied from encrypt-auth.go and decrypt-test.go, see
+// `checkCopies`
+var copied = []string{"sha256Digest", "sha256H0", "sha256K", "newSHA256", "sha256Digest.write", "sha256Digest.sum", "sha256Compress"}
+
+// the messages and hashes of the SHA-256 examples published by NIST
+var vectors = []struct {
+  message, hash string
+}{
+  {"abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+  {"", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+  {"abcdbcdecdefdefgefghfghighijhijkijkljklmklmnlmnomnopnopq", "248d6a61d20638b8e5c026930c3e6039a33ce45964ff2167f6ecedd419db06c1"},
+  {"abcdefghbcdefghicdefghijdefghijkefghijklfghijklmghijklmnhijklmnoijklmnopjklmnopqklmnopqrlmnopqrsmnopqrstnopqrstu", "cf5b16a778af8380036ce59e7b0492370b249b11e8f07a51afac45037afee9d1"},
+  {strings.Repeat("a", 1000000), "cdc76e5c9914fb9281a1c7e284d73e67f1809a48a497200e046d39ccc7112cd0"},
+}
+
+//routine for error handling
+func check(e error) {
+  if e != nil {
+    panic(e)
+  }
+}
+
+func main() {
+  nFlag := flag.Int("n", 1000, "number of random messages to compare with crypto/sha256")
+  traceFlag := flag.String("trace", "", "text whose hashing is printed block by block, instead of checking anything")
+  srcFlag := flag.String("src", ".", "directory holding encrypt-auth.go, decrypt-test.go and sha256-check.go")
+  flag.Parse()
+  if flag.NArg() != 0 || *nFlag < 0 {
+    fmt.Println("usage: go run sha256-check.go [-n <number of random messages>] [-trace <text>] [-src <directory>]")
+    os.Exit(1)
+  }
+  if *traceFlag != "" {
+    trace([]byte(*traceFlag))
+    return
+  }
+
+  failed := checkCopies(*srcFlag, "sha256-check.go", "encrypt-auth.go", "decrypt-test.go")
+  for _, v := range vectors {
+    d := newSHA256()
+    d.write([]byte(v.message))
+    got := hex.EncodeToString(d.sum())
+    name := v.message
+    if len(name) > 20 {
+      name = fmt.Sprintf("%s... (%d bytes)", name[:20], len(name))
+    }
+    if got != v.hash {
+      failed++
+      fmt.Printf("FAIL  %q: got %s, want %s\n", name, got, v.hash)
+    } else {
+      fmt.Printf("PASS  %q\n", name)
+    }
+  }
+
+  // random lengths around a few blocks, cut into random pieces so that the
+  // buffering in `write` gets exercised too
+  mismatches := 0
+  for i := 0; i < *nFlag; i++ {
+    message := make([]byte, randomInt(300))
+    _, err := rand.Read(message)
+    check(err)
+    d := newSHA256()
+    for rest := message; len(rest) > 0; {
+      piece := randomInt(len(rest) + 1)
+      d.write(rest[:piece])
+      rest = rest[piece:]
+    }
+    want := sha256.Sum256(message)
+    if hex.EncodeToString(d.sum()) != hex.EncodeToString(want[:]) {
+      mismatches++
+      if mismatches <= 5 {
+        fmt.Printf("FAIL  random message %x\n", message)
+      }
+    }
+  }
+  fmt.Printf("%d of %d random messages hash the same as crypto/sha256\n", *nFlag - mismatches, *nFlag)
+  if failed + mismatches != 0 {
+    os.Exit(1)
+  }
+}
+
+/*
+Hash `text` one block at a time, the padding included, and print each block
+with the chaining value it leaves behind. The last one is the hash.
+*/
+func trace(text []byte) {
+  d := newSHA256()
+  d.write(text)
+  padded := append([]byte{}, text...)
+  padded = append(padded, 0x80)
+  for len(padded) % 64 != 56 {
+    padded = append(padded, 0)
+  }
+  bitLen := make([]byte, 8)
+  binary.BigEndian.PutUint64(bitLen, uint64(len(text)) * 8)
+  padded = append(padded, bitLen...)
+  h := sha256H0
+  fmt.Printf("H0        %s\n", chainingValue(h))
+  for i := 0; i < len(padded); i += 64 {
+    sha256Compress(&h, padded[i : i + 64])
+    fmt.Printf("block %-3d %x\n          %s\n", i / 64 + 1, padded[i : i + 64], chainingValue(h))
+  }
+  fmt.Printf("hash      %x\n", d.sum())
+}
+
+// the eight words of a chaining value in hex
+func chainingValue(h [8]uint32) string {
+  words := make([]string, 8)
+  for i := range h {
+    words[i] = fmt.Sprintf("%08x", h[i])
+  }
+  return strings.Join(words, " ")
+}
+
+/*
+Compare the declarations in `copied` with the ones in each of the `originals`,
+text and doc comments included, all of them read from `src`. A change made to
+one of those programs but not to the copy here then fails the check, instead
+of leaving it to test code that no longer ships. Returns the number of
+declarations that differ.
+*/
+func checkCopies(src, own string, originals ...string) int {
+  mine := declarations(filepath.Join(src, own))
+  failed := 0
+  for _, original := range originals {
+    theirs := declarations(filepath.Join(src, original))
+    for _, name := range copied {
+      if mine[name] == "" || mine[name] != theirs[name] {
+        failed++
+        fmt.Printf("FAIL  %s is not the same as in %s\n", name, original)
+      }
+    }
+  }
+  if failed == 0 {
+    fmt.Printf("PASS  %d declarations the same as in %s\n", len(copied), strings.Join(originals, " and "))
+  }
+  return failed
+}
+
+/*
+The source text of every top-level declaration in the Go file `fileName`, from
+its doc comment to its end, by name. Methods go by "Type.method", and every
+name in a grouped declaration maps to the whole group.
+*/
+func declarations(fileName string) map[string]string {
+  data, err := ioutil.ReadFile(fileName)
+  check(err)
+  fset := token.NewFileSet()
+  file, err := parser.ParseFile(fset, fileName, data, parser.ParseComments)
+  check(err)
+  res := map[string]string{}
+  for _, decl := range file.Decls {
+    start := decl.Pos()
+    var names []string
+    switch d := decl.(type) {
+    case *ast.FuncDecl:
+      if d.Doc != nil {
+        start = d.Doc.Pos()
+      }
+      name := d.Name.Name
+      if d.Recv != nil {
+        recv := d.Recv.List[0].Type
+        if star, ok := recv.(*ast.StarExpr); ok {
+          recv = star.X
+        }
+        name = recv.(*ast.Ident).Name + "." + name
+      }
+      names = append(names, name)
+    case *ast.GenDecl:
+      if d.Doc != nil {
+        start = d.Doc.Pos()
+      }
+      for _, spec := range d.Specs {
+        switch s := spec.(type) {
+        case *ast.TypeSpec:
+          names = append(names, s.Name.Name)
+        case *ast.ValueSpec:
+          for _, n := range s.Names {
+            names = append(names, n.Name)
+          }
+        }
+      }
+    }
+    text := string(data[fset.Position(start).Offset:fset.Position(decl.End()).Offset])
+    for _, name := range names {
+      res[name] = text
+    }
+  }
+  return res
+}
+
+// a random integer in [0, n)
+func randomInt(n int) int {
+  res, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+  check(err)
+  return int(res.Int64())
+}
+
+/*
+SHA-256 written out by hand, following FIPS 180-4. The internal state is left
+in the open: `h` is the chaining value after the first `length` bytes written,
+less the ones in `buf`, which are waiting for a whole 64-byte block. Setting
+`h` and `length` to a hash and the length it covered carries that hash on.
+*/
+type sha256Digest struct {
+  h [8]uint32
+  buf []byte
+  length uint64
+}
+
+// initial chaining value: the first 32 bits of the fractional parts of the
+// square roots of the first 8 primes
+var sha256H0 = [8]uint32{
+  0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+// round constants: the first 32 bits of the fractional parts of the cube
+// roots of the first 64 primes
+var sha256K = [64]uint32{
+  0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+  0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+  0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+  0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+  0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+  0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+  0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+  0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+}
+
+func newSHA256() *sha256Digest {
+  return &sha256Digest{h: sha256H0}
+}
+
+// hash `data`, one 64-byte block at a time
+func (d *sha256Digest) write(data []byte) {
+  d.length += uint64(len(data))
+  d.buf = append(d.buf, data...)
+  for len(d.buf) >= 64 {
+    sha256Compress(&d.h, d.buf[:64])
+    d.buf = d.buf[64:]
+  }
+}
+
+/*
+The hash of everything written so far. The message is padded with 0x80, zeros
+up to 8 bytes short of a whole block, and the length in bits as a 64-bit
+big-endian integer. This works on a copy of the state, so more can be written
+afterwards.
+*/
+func (d *sha256Digest) sum() []byte {
+  h := d.h
+  rest := append(append([]byte{}, d.buf...), 0x80)
+  for len(rest) % 64 != 56 {
+    rest = append(rest, 0)
+  }
+  bitLen := make([]byte, 8)
+  binary.BigEndian.PutUint64(bitLen, d.length * 8)
+  rest = append(rest, bitLen...)
+  for i := 0; i < len(rest); i += 64 {
+    sha256Compress(&h, rest[i : i + 64])
+  }
+  res := make([]byte, 32)
+  for i := range h {
+    binary.BigEndian.PutUint32(res[4 * i:], h[i])
+  }
+  return res
+}
+
+/*
+The SHA-256 compression function (FIPS 180-4, section 6.2.2): mix one 64-byte
+block into the chaining value `h`.
+*/
+func sha256Compress(h *[8]uint32, block []byte) {
+  // message schedule
+  var w [64]uint32
+  for t := 0; t < 16; t++ {
+    w[t] = binary.BigEndian.Uint32(block[4 * t:])
+  }
+  for t := 16; t < 64; t++ {
+    s0 := bits.RotateLeft32(w[t - 15], -7) ^ bits.RotateLeft32(w[t - 15], -18) ^ (w[t - 15] >> 3)
+    s1 := bits.RotateLeft32(w[t - 2], -17) ^ bits.RotateLeft32(w[t - 2], -19) ^ (w[t - 2] >> 10)
+    w[t] = w[t - 16] + s0 + w[t - 7] + s1
+  }
+  a, b, c, d, e, f, g, hh := h[0], h[1], h[2], h[3], h[4], h[5], h[6], h[7]
+  for t := 0; t < 64; t++ {
+    S1 := bits.RotateLeft32(e, -6) ^ bits.RotateLeft32(e, -11) ^ bits.RotateLeft32(e, -25)
+    ch := (e & f) ^ (^e & g)
+    t1 := hh + S1 + ch + sha256K[t] + w[t]
+    S0 := bits.RotateLeft32(a, -2) ^ bits.RotateLeft32(a, -13) ^ bits.RotateLeft32(a, -22)
+    maj := (a & b) ^ (a & c) ^ (b & c)
+    t2 := S0 + maj
+    hh, g, f, e, d, c, b, a = g, f, e, d + t1, c, b, a, t1 + t2
+  }
+  h[0] += a
+  h[1] += b
+  h[2] += c
+  h[3] += d
+  h[4] += e
+  h[5] += f
+  h[6] += g
+  h[7] += hh
+}